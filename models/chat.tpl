@@ -1,4 +1,15 @@
+{{- if .Tools }}
+system: You can call the following tools:
+{{- range .Tools }}
+- {{.Function.Name}}: {{.Function.Description}} Parameters: {{json .Function.Parameters}}
+{{- end}}
+To call tools, respond with only a JSON array like [{"name": "tool name", "arguments": {}}].
+{{- end}}
 {{- range .Input }}
+{{- if .ToolCalls }}
+{{.Role}}: {{toolCalls .ToolCalls}}
+{{- else }}
 {{.Role}}: {{.Content}}
 {{- end}}
+{{- end}}
 assistant:
\ No newline at end of file
@@ -15,6 +15,11 @@ func (p *Params) SetSeed(seed int32) {
 	p.seed = C.int(seed)
 }
 
+// Seed returns seed of sample operation
+func (p *Params) Seed() int32 {
+	return int32(p.seed)
+}
+
 // SetF16KV enables use f16 kv
 func (p *Params) SetF16KV(enable bool) {
 	p.f16_kv = C.bool(enable)
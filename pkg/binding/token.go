@@ -22,6 +22,21 @@ llama_token_data_array* new_token_data_array(unsigned long size, bool sorted) {
 */
 import "C"
 
+// ID of token data
+func (t *TokenData) ID() int32 {
+	return int32(t.id)
+}
+
+// Logit of token data
+func (t *TokenData) Logit() float32 {
+	return float32(t.logit)
+}
+
+// P of token data
+func (t *TokenData) P() float32 {
+	return float32(t.p)
+}
+
 // SetID for token data
 func (t *TokenData) SetID(id int32) {
 	t.id = C.int(id)
@@ -53,6 +68,32 @@ func (t *TokenDataArray) Data() []TokenData {
 	return data
 }
 
+// Reset restores size of TokenDataArray to reuse its memory, size should not exceed the allocated size
+func (t *TokenDataArray) Reset(size int) {
+	t.size = C.ulong(size)
+	t.sorted = C.bool(false)
+}
+
+// Size returns number of TokenData
+func (t *TokenDataArray) Size() int {
+	return int(t.size)
+}
+
+// SetSize shrinks TokenDataArray to its first size TokenData
+func (t *TokenDataArray) SetSize(size int) {
+	t.size = C.ulong(size)
+}
+
+// Sorted returns if TokenData are sorted by logit in descending order
+func (t *TokenDataArray) Sorted() bool {
+	return bool(t.sorted)
+}
+
+// SetSorted marks if TokenData are sorted by logit in descending order
+func (t *TokenDataArray) SetSorted(sorted bool) {
+	t.sorted = C.bool(sorted)
+}
+
 // Free to release memory
 func (t *TokenDataArray) Free() {
 	C.free(unsafe.Pointer(t.data))
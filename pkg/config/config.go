@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 	"k8s.io/klog/v2"
@@ -20,6 +22,11 @@ type Config struct {
 	EnableSession bool
 	SessionDir    string
 
+	// SchedulePolicy decides the order of queued requests
+	SchedulePolicy string
+	// APIKeyPriorities is the priority class of api keys
+	APIKeyPriorities map[string]int
+
 	ModelConfigs map[string]ModelConfig
 }
 
@@ -45,12 +52,66 @@ type ModelConfig struct {
 	LoraPath       *string `yaml:"loraPath"`
 	Verbose        bool    `yaml:"verbose"`
 	GPULayers      int     `yaml:"gpuLayers"`
+	// Parallel is the number of contexts created for the model, requests are run concurrently on them
+	Parallel int `yaml:"parallel"`
 
 	PromptTemplates map[string]string `yaml:"promptTemplates"`
 	Roles           map[string]string `yaml:"roles"`
 	Stops           []string          `yaml:"stops"`
 
-	Session SessionConfig `yaml:"session"`
+	Session  SessionConfig  `yaml:"session"`
+	Sampling SamplingConfig `yaml:"sampling"`
+	Queue    QueueConfig    `yaml:"queue"`
+	// PrefixCache is config of snapshots shared by requests with the same prompt prefix
+	PrefixCache PrefixCacheConfig `yaml:"prefixCache"`
+	// Truncation is config of chat history which exceeds context, overridden by request
+	Truncation TruncationConfig `yaml:"truncation"`
+	// ContextShift is config of generation beyond context size, overridden by request
+	ContextShift ContextShiftConfig `yaml:"contextShift"`
+	// DraftModel is name of a smaller model sharing the vocab, which drafts tokens verified by the model in one
+	// batch. Generated tokens follow the same distribution as without it.
+	DraftModel string `yaml:"draftModel"`
+	// DraftTokens is the max number of tokens drafted at a time, 4 by default
+	DraftTokens int `yaml:"draftTokens"`
+	// Guidance creates a second context beside every context of the model, which evaluates negative prompts of
+	// classifier-free guidance
+	Guidance bool `yaml:"guidance"`
+}
+
+// ContextShiftConfig is config of generation beyond context size
+type ContextShiftConfig struct {
+	// Enable keeps generating when context is full, by discarding half of tokens after the first keep tokens
+	Enable bool `yaml:"enable"`
+	// Keep is the number of leading tokens kept, -1 keeps the whole prompt
+	Keep int `yaml:"keep"`
+}
+
+// TruncationConfig is config of chat history which exceeds context
+type TruncationConfig struct {
+	// Strategy is one of none, drop_oldest, last_messages, middle_out and summarize, none fails the request
+	Strategy string `yaml:"strategy"`
+	// LastMessages is the number of user and assistant messages kept by last_messages, 10 by default
+	LastMessages int `yaml:"lastMessages"`
+	// SummaryMaxTokens is the max length of summary written by summarize, 256 by default
+	SummaryMaxTokens int `yaml:"summaryMaxTokens"`
+}
+
+// PrefixCacheConfig is config of prompt prefix cache
+type PrefixCacheConfig struct {
+	// MaxBytes is the budget of cached snapshots, 0 disables the cache
+	MaxBytes int64 `yaml:"maxBytes"`
+	// MinTokens is the min number of newly evaluated prompt tokens worth a snapshot, 64 by default
+	MinTokens int `yaml:"minTokens"`
+}
+
+// QueueConfig is config of requests waiting for a free context of model
+type QueueConfig struct {
+	// MaxDepth is the max number of waiting requests, 0 means unlimited
+	MaxDepth int `yaml:"maxDepth"`
+	// Timeout is the max wait time of a request, 0 means no timeout
+	Timeout time.Duration `yaml:"timeout"`
+	// RetryAfter is suggested to clients whose requests are rejected
+	RetryAfter time.Duration `yaml:"retryAfter"`
 }
 
 // SessionConfig is config for session
@@ -58,12 +119,76 @@ type SessionConfig struct {
 	Enable    bool    `yaml:"enable"`
 	Path      string  `yaml:"path"`
 	Threshold float32 `yaml:"threshold"`
+	// Store is where session states are kept, one of file, memory and redis
+	Store string `yaml:"store"`
+	// Cache is config of memory store
+	Cache SessionCacheConfig `yaml:"cache"`
+	// Redis is config of redis store
+	Redis RedisConfig `yaml:"redis"`
+	// TTL is how long an unused state is kept, 0 means forever
+	TTL time.Duration `yaml:"ttl"`
+	// MaxBytes is the budget of all stored states, the least recently used states are removed beyond it
+	MaxBytes int64 `yaml:"maxBytes"`
+	// GCInterval is how often expired states are collected, one minute by default
+	GCInterval time.Duration `yaml:"gcInterval"`
+	// Compress compresses persisted states
+	Compress bool `yaml:"compress"`
+	// EncryptionKey is a hex or base64 encoded AES key of 16, 24 or 32 bytes, persisted states are encrypted with
+	// AES-GCM when it is set. Environment variable GO_LLAMA_SESSION_KEY is used when it is empty.
+	EncryptionKey string `yaml:"encryptionKey"`
+}
+
+// RedisConfig is config for redis session store
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// Timeout is the deadline of a command including transfer of its state, 30 seconds by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// SessionCacheConfig is config for in-memory session cache
+type SessionCacheConfig struct {
+	// MaxBytes is the budget of cached states, memory store is used by default when it is set
+	MaxBytes int64 `yaml:"maxBytes"`
+	// SpillPath is where states evicted from memory are written, empty means evicted states are dropped
+	SpillPath string `yaml:"spillPath"`
+}
+
+// SamplingConfig is default sampling options of model, overridden by request
+type SamplingConfig struct {
+	Temperature         *float32 `yaml:"temperature"`
+	TopP                *float32 `yaml:"topP"`
+	TopK                *int     `yaml:"topK"`
+	TfsZ                *float32 `yaml:"tfsZ"`
+	TypicalP            *float32 `yaml:"typicalP"`
+	RepeatPenalty       *float32 `yaml:"repeatPenalty"`
+	RepeatLastN         *int     `yaml:"repeatLastN"`
+	FrequencyPenalty    *float32 `yaml:"frequencyPenalty"`
+	PresencePenalty     *float32 `yaml:"presencePenalty"`
+	Mirostat            *int     `yaml:"mirostat"`
+	MirostatTau         *float32 `yaml:"mirostatTau"`
+	MirostatEta         *float32 `yaml:"mirostatEta"`
+	PenalizeNL          *bool    `yaml:"penalizeNL"`
+	Seed                *int     `yaml:"seed"`
+	MinP                *float32 `yaml:"minP"`
+	TopA                *float32 `yaml:"topA"`
+	DryMultiplier       *float32 `yaml:"dryMultiplier"`
+	DryBase             *float32 `yaml:"dryBase"`
+	DryAllowedLength    *int     `yaml:"dryAllowedLength"`
+	DryPenaltyLastN     *int     `yaml:"dryPenaltyLastN"`
+	DrySequenceBreakers []string `yaml:"drySequenceBreakers"`
+	XTCProbability      *float32 `yaml:"xtcProbability"`
+	XTCThreshold        *float32 `yaml:"xtcThreshold"`
+	// LogitsProcessors is names of logits processors applied in order, an empty list disables all of them
+	LogitsProcessors []string `yaml:"logitsProcessors"`
 }
 
 // New returns a Config instance
 func New() *Config {
 	return &Config{
-		ModelConfigs: map[string]ModelConfig{},
+		ModelConfigs:     map[string]ModelConfig{},
+		APIKeyPriorities: map[string]int{},
 	}
 }
 
@@ -73,6 +198,26 @@ func (c *Config) Init(flag *flag.FlagSet) {
 	flag.StringVar(&c.ModelPath, "model-path", "models", "where you store models")
 	flag.StringVar(&c.Host, "host", "0.0.0.0", "server host address to listen")
 	flag.IntVar(&c.Port, "port", 8000, "server port to listen")
+	flag.StringVar(&c.SchedulePolicy, "schedule-policy", "priority-fair", "order of queued requests, one of fifo, priority, fair and priority-fair")
+	flag.Func("api-key-priorities", "priority class of api keys, such as key1=10,key2=-10, requests can only lower priority of their key", c.parseAPIKeyPriorities)
+}
+
+func (c *Config) parseAPIKeyPriorities(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		key, priority, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid api key priority: %s", item)
+		}
+		p, err := strconv.Atoi(strings.TrimSpace(priority))
+		if err != nil {
+			return fmt.Errorf("invalid api key priority: %s, err: %v", item, err)
+		}
+		c.APIKeyPriorities[strings.TrimSpace(key)] = p
+	}
+	return nil
 }
 
 // LoadModelConfigs from model path
@@ -1,6 +1,7 @@
 package context
 
 import (
+	"fmt"
 	"sync"
 
 	"k8s.io/klog/v2"
@@ -8,19 +9,23 @@ import (
 	"github.com/bdqfork/go-llama.cpp/pkg/config"
 	"github.com/bdqfork/go-llama.cpp/pkg/llm"
 	"github.com/bdqfork/go-llama.cpp/pkg/model"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
 )
 
 // Context manages all runtime infomation, include configuration and model instances
 type Context struct {
 	Config *config.Config
 	llms   map[string]llm.LLM
-	locker sync.Mutex
+	// sessions is session stores by model name, which are shared by llms and opened without loading models
+	sessions map[string]session.Store
+	locker   sync.Mutex
 }
 
 // New return a context instance
 func New(c *config.Config) *Context {
 	ctx := &Context{Config: c}
 	ctx.llms = make(map[string]llm.LLM)
+	ctx.sessions = make(map[string]session.Store)
 	return ctx
 }
 
@@ -34,15 +39,157 @@ func (ctx *Context) LLM(name string) (llm.LLM, error) {
 	}
 
 	modelConfig := ctx.Config.ModelConfigs[name]
-	model, err := ctx.loadModel(modelConfig)
+	policy, err := llm.ParseSchedulePolicy(ctx.Config.SchedulePolicy)
 	if err != nil {
 		return nil, err
 	}
-	l := llm.New(model, &modelConfig)
+	if err := model.ValidateLogitsProcessors(modelConfig.Sampling.LogitsProcessors); err != nil {
+		return nil, err
+	}
+	if _, err := llm.ParseTruncationStrategy(modelConfig.Truncation.Strategy); err != nil {
+		return nil, err
+	}
+	var draftConfig *config.ModelConfig
+	if modelConfig.DraftModel != "" {
+		c, ok := ctx.Config.ModelConfigs[modelConfig.DraftModel]
+		if !ok || modelConfig.DraftModel == name {
+			return nil, fmt.Errorf("invalid draft model %s of model %s", modelConfig.DraftModel, name)
+		}
+		// drafted tokens are verified by logits of every token in a batch, and draft context follows all
+		// tokens evaluated by the model
+		modelConfig.LogitsAll = true
+		c.Context = modelConfig.Context
+		c.Embedding = false
+		draftConfig = &c
+	}
+	parallel := modelConfig.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	// contexts share weights of model through mmap
+	models := make([]model.Model, 0, parallel)
+	var drafts, guidances []model.Model
+	for i := 0; i < parallel; i++ {
+		m, err := ctx.loadModel(modelConfig)
+		if err != nil {
+			closeModels(models, drafts, guidances)
+			return nil, err
+		}
+		models = append(models, m)
+		if draftConfig != nil {
+			draft, err := ctx.loadDraftModel(m, *draftConfig)
+			if err != nil {
+				closeModels(models, drafts, guidances)
+				return nil, err
+			}
+			drafts = append(drafts, draft)
+		}
+		if modelConfig.Guidance {
+			// guidance context only needs logits of the last token
+			guidanceConfig := modelConfig
+			guidanceConfig.LogitsAll = false
+			guidanceConfig.Embedding = false
+			guidance, err := ctx.loadModel(guidanceConfig)
+			if err != nil {
+				closeModels(models, drafts, guidances)
+				return nil, err
+			}
+			guidances = append(guidances, guidance)
+		}
+	}
+	sessions, err := ctx.sessionStore(name)
+	if err != nil {
+		closeModels(models, drafts, guidances)
+		return nil, err
+	}
+	l := llm.NewPool(models, drafts, guidances, &modelConfig, policy, sessions)
 	ctx.llms[name] = l
 	return l, nil
 }
 
+// LoadedLLMs returns LLM instances loaded so far by model name
+func (ctx *Context) LoadedLLMs() map[string]llm.LLM {
+	ctx.locker.Lock()
+	defer ctx.locker.Unlock()
+
+	llms := make(map[string]llm.LLM, len(ctx.llms))
+	for name, l := range ctx.llms {
+		llms[name] = l
+	}
+	return llms
+}
+
+// SessionStores returns session stores of models with session enabled, or of the named model only if name is
+// set. Stores are opened without loading models.
+func (ctx *Context) SessionStores(name string) (map[string]session.Store, error) {
+	ctx.locker.Lock()
+	defer ctx.locker.Unlock()
+
+	names := []string{name}
+	if name == "" {
+		names = names[:0]
+		for modelName, modelConfig := range ctx.Config.ModelConfigs {
+			if modelConfig.Session.Enable {
+				names = append(names, modelName)
+			}
+		}
+	} else if _, ok := ctx.Config.ModelConfigs[name]; !ok {
+		return nil, fmt.Errorf("model %s not found", name)
+	}
+
+	stores := make(map[string]session.Store, len(names))
+	for _, modelName := range names {
+		store, err := ctx.sessionStore(modelName)
+		if err != nil {
+			return nil, err
+		}
+		stores[modelName] = store
+	}
+	return stores, nil
+}
+
+// sessionStore returns session store of model, which is opened on first use
+func (ctx *Context) sessionStore(name string) (session.Store, error) {
+	if store, ok := ctx.sessions[name]; ok {
+		return store, nil
+	}
+	modelConfig := ctx.Config.ModelConfigs[name]
+	store, err := session.New(&modelConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx.sessions[name] = store
+	return store, nil
+}
+
+// loadDraftModel loads a context of draft model for m, which should share the vocab of m
+func (ctx *Context) loadDraftModel(m model.Model, draftConfig config.ModelConfig) (model.Model, error) {
+	draft, err := ctx.loadModel(draftConfig)
+	if err != nil {
+		return nil, err
+	}
+	vocab, draftVocab := m.Vocab(), draft.Vocab()
+	if len(vocab) != len(draftVocab) {
+		draft.Close()
+		return nil, fmt.Errorf("vocab of draft model %s differs, size: %d, expected: %d", draftConfig.Name, len(draftVocab), len(vocab))
+	}
+	for i := range vocab {
+		if vocab[i] != draftVocab[i] {
+			draft.Close()
+			return nil, fmt.Errorf("vocab of draft model %s differs at token %d", draftConfig.Name, i)
+		}
+	}
+	return draft, nil
+}
+
+func closeModels(groups ...[]model.Model) {
+	for _, models := range groups {
+		for _, m := range models {
+			m.Close()
+		}
+	}
+}
+
 func (ctx *Context) loadModel(modelConfig config.ModelConfig) (model.Model, error) {
 	modelOptions := make([]model.Option, 0)
 
@@ -104,5 +251,10 @@ func (ctx *Context) Close() error {
 	for _, l := range ctx.llms {
 		l.Close()
 	}
+	for name, store := range ctx.sessions {
+		if err := store.Close(); err != nil {
+			klog.Errorf("failed to close session store of model %s, err: %v", name, err)
+		}
+	}
 	return nil
 }
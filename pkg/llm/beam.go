@@ -0,0 +1,201 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+var (
+	errBeamSearchStream  = errors.New("beam search does not support stream")
+	errBeamSearchGrammar = errors.New("beam search does not support grammar")
+)
+
+// beam is a live sequence of beam search
+type beam struct {
+	tokens   []binding.Token
+	text     string
+	logprob  float32
+	logprobs []tokenLogprob
+	// logits is logits of the next token
+	logits []float32
+	// state is a snapshot of context after prompt and tokens are evaluated
+	state *model.State
+	// parent is the beam extended by the last token, until the token is evaluated
+	parent *beam
+}
+
+// beamCandidate is a beam extended by a token
+type beamCandidate struct {
+	parent  *beam
+	token   binding.Token
+	logprob float32
+}
+
+// beamSearch generates the most likely continuations of prompt, keeping numBeams sequences of highest log
+// probability at every step. Every beam forks context by a snapshot. Finished sequences are ranked by log
+// probability divided by length to the power of length penalty, the best n of them are returned as choices.
+// Sampling options are not used.
+func (l *llm) beamSearch(ctx context.Context, promptTokens []binding.Token, matchNum, maxTokens int, stops []string, p *params) ([]*choice, error) {
+	numBeams := p.numBeams
+	if err := l.Eval(promptTokens[matchNum:]); err != nil {
+		return nil, err
+	}
+	root := &beam{logits: l.lastLogits()}
+
+	beams := []*beam{root}
+	finished := make([]*choice, 0, numBeams)
+	score := func(logprob float32, length int) float32 {
+		return logprob / float32(math.Pow(float64(length), float64(p.lengthPenalty)))
+	}
+	// maxLen is the most tokens a beam can reach, which divides log probability the most with positive length
+	// penalty
+	maxLen := maxTokens
+	if n := l.ContextSize() - len(promptTokens); n < maxLen {
+		maxLen = n
+	}
+
+	for len(beams) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		// every beam proposes twice as many tokens as beams, so that enough of them are left besides finished ones
+		candidates := make([]beamCandidate, 0, len(beams)*numBeams*2)
+		for _, b := range beams {
+			lse := model.LogSumExp(b.logits)
+			for _, token := range topLogprobs(b.logits, numBeams*2) {
+				candidates = append(candidates, beamCandidate{parent: b, token: token, logprob: b.logprob + b.logits[token] - lse})
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].logprob > candidates[j].logprob
+		})
+
+		next := make([]*beam, 0, numBeams)
+		for rank, cand := range candidates {
+			if len(next) == numBeams {
+				break
+			}
+			b := l.extendBeam(cand, p)
+			finishReason := ""
+			outTokenNum := len(b.tokens)
+			if cand.token == binding.TokenEos() || p.stopTokens[cand.token] {
+				finishReason = "stop"
+				b.text = cand.parent.text
+			} else if at := indexAnyStop(b.text, stops, len(cand.parent.text)); at >= 0 {
+				finishReason = "stop"
+				b.text = b.text[:at]
+			} else if outTokenNum >= maxTokens || len(promptTokens)+outTokenNum >= l.ContextSize() {
+				finishReason = "length"
+			}
+			if finishReason == "" {
+				next = append(next, b)
+				continue
+			}
+			// a finished sequence ranked below beams would not have been kept by a live beam
+			if rank < numBeams {
+				finished = append(finished, &choice{tokens: b.tokens, text: b.text, logprob: b.logprob, logprobs: b.logprobs, finishReason: finishReason})
+			}
+		}
+
+		sort.SliceStable(finished, func(i, j int) bool {
+			return score(finished[i].logprob, len(finished[i].tokens)) > score(finished[j].logprob, len(finished[j].tokens))
+		})
+		if len(finished) > numBeams {
+			finished = finished[:numBeams]
+		}
+		if len(finished) == numBeams && len(next) > 0 {
+			// log probability only decreases, so the best live beam can not score higher than its log probability
+			// divided by the longest length with positive length penalty, or by its current length otherwise
+			bestLen := len(next[0].tokens)
+			if p.lengthPenalty > 0 && maxLen > bestLen {
+				bestLen = maxLen
+			}
+			worst := finished[len(finished)-1]
+			if p.earlyStopping || score(worst.logprob, len(worst.tokens)) >= score(next[0].logprob, bestLen) {
+				break
+			}
+		}
+
+		// beams of the same parent are evaluated in a row, so that context is restored once for them
+		for _, parent := range beams {
+			for _, b := range next {
+				if b.parent != parent {
+					continue
+				}
+				if err := l.evalBeam(promptTokens, b); err != nil {
+					return nil, err
+				}
+			}
+		}
+		beams = next
+	}
+
+	if len(finished) > p.n {
+		finished = finished[:p.n]
+	}
+	for i, c := range finished {
+		c.index = i
+	}
+	klog.V(3).Infof("beam search finished, beams: %d, choices: %d", numBeams, len(finished))
+	return finished, nil
+}
+
+// extendBeam returns the beam of candidate, which is not evaluated yet
+func (l *llm) extendBeam(cand beamCandidate, p *params) *beam {
+	parent := cand.parent
+	out := l.Detokenize([]binding.Token{cand.token})
+	b := &beam{
+		tokens:  append(parent.tokens[:len(parent.tokens):len(parent.tokens)], cand.token),
+		text:    parent.text + out,
+		logprob: cand.logprob,
+		parent:  parent,
+	}
+	if p.logprobs {
+		lse := model.LogSumExp(parent.logits)
+		b.logprobs = append(parent.logprobs[:len(parent.logprobs):len(parent.logprobs)], l.tokenLogprob(parent.logits, lse, cand.token, len(parent.text), p.topLogprobs))
+	}
+	return b
+}
+
+// evalBeam evaluates the last token of b on context of its parent, and snapshots context for b. Snapshot of
+// parent is released after its beams are evaluated.
+func (l *llm) evalBeam(promptTokens []binding.Token, b *beam) error {
+	tokens := append(promptTokens[:len(promptTokens):len(promptTokens)], b.tokens...)
+	parentNum := len(tokens) - 1
+	// context is reused when it holds the parent, which is common for beams sharing a parent
+	if commonPrefix(l.Tokens(), tokens) < parentNum {
+		if b.parent.state == nil || l.Model.LoadState(b.parent.state, tokens) != parentNum {
+			return fmt.Errorf("failed to restore context of beam, token num: %d", parentNum)
+		}
+	}
+	l.Rewind(parentNum)
+	if err := l.Eval(tokens[parentNum:]); err != nil {
+		return err
+	}
+	b.logits = l.lastLogits()
+
+	state, err := l.Model.SaveState()
+	if err != nil {
+		return err
+	}
+	b.state = state
+	b.parent = nil
+	return nil
+}
+
+// lastLogits returns logits of the last evaluated token
+func (l *llm) lastLogits() []float32 {
+	logits := l.Logits()
+	return logits[len(logits)-1]
+}
@@ -2,23 +2,22 @@ package llm
 
 import (
 	"context"
-	"fmt"
-	"strings"
+	"errors"
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/klog/v2"
 
 	"github.com/bdqfork/go-llama.cpp/pkg/binding"
-	"github.com/bdqfork/go-llama.cpp/pkg/model"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
 )
 
-func (l *llm) ChatCompletion(ctx context.Context, id string, input []ChatCompletionMessage, stops []string, maxTokens int, opts ...model.SampleOption) (*ChatCompletion, error) {
+func (l *llm) ChatCompletion(ctx context.Context, id string, input []ChatCompletionMessage, stops []string, maxTokens int, opts ...Option) (*ChatCompletion, error) {
+	p := newParams(opts...)
+
 	l.locker.Lock()
 	defer l.locker.Unlock()
 
-	l.Reset()
-
 	if l.modelConfig.Verbose {
 		defer l.Model.PrintTimings()
 	}
@@ -27,113 +26,80 @@ func (l *llm) ChatCompletion(ctx context.Context, id string, input []ChatComplet
 		stops = append(stops, l.modelConfig.Stops...)
 	}
 
-	promptTemplate := l.templates["chat"]
-
-	renderedPrompt, err := render(promptTemplate, input)
-	if err != nil {
-		klog.Errorf("failed to render prompt template: %v, input: %v, err: %v", promptTemplate, input, err)
+	if err := applyToolChoice(p); err != nil {
 		return nil, err
 	}
 
-	klog.V(3).Infof("rendered prompt: %v", renderedPrompt)
-
-	promptTokens, err := l.Tokenize(renderedPrompt, true)
+	promptTokens, err := l.fitChatPrompt(ctx, input, maxTokens, p)
 	if err != nil {
-		klog.Errorf("failed to tokenize, prompt: %+v, err: %v", renderedPrompt, err)
 		return nil, err
 	}
-
 	promptTokenNum := len(promptTokens)
 
-	if promptTokenNum >= *l.modelConfig.Context {
-		return nil, fmt.Errorf("tokens exceeds max context size: %d", *l.modelConfig.Context)
+	if err := l.tokenizeNegativeChatPrompt(input, p); err != nil {
+		return nil, err
 	}
 
-	sessionFilepath := l.generateSessionFilepath(id)
+	matchNum, sessionNum := l.restoreSession(id, promptTokens)
 
-	matchNum := 0
-	if l.modelConfig.Session.Enable {
-		matchNum, err = l.Model.LoadSession(sessionFilepath, promptTokens)
-		if err != nil {
-			klog.Errorf("failed to load session, err: %v", err)
-			return nil, err
-		}
-		klog.V(3).Infof("session %s state found, match token num: %d", id, matchNum)
-		promptTokens = promptTokens[matchNum:]
-		klog.V(3).Infof("current prompt tokens num: %d", len(promptTokens))
+	candidates, err := l.generateChoices(ctx, promptTokens, matchNum, p.bestOf, maxTokens, stops, nil, p)
+	if err != nil {
+		return nil, err
 	}
-
-	tokenGenerator := l.generate(promptTokens, opts...)
+	l.cachePrefix(promptTokens, matchNum)
 
 	outTokenNum := 0
+	draftedNum, acceptedNum := 0, 0
+	for _, c := range candidates {
+		outTokenNum += len(c.tokens)
+		draftedNum += c.draftedNum
+		acceptedNum += c.acceptedNum
+	}
 
-	builder := strings.Builder{}
-
-	finish := false
-	finishReason := ""
-
-	for !finish {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			token, err := tokenGenerator()
-			if err != nil {
-				klog.Errorf("failed to generate, token: %v, err: %v", token, err)
-				return nil, err
-			}
-			outTokenNum++
-			out := l.Detokenize([]binding.Token{token})
-			klog.V(4).Infof("got token %d, out: %v", token, out)
-
-			builder.Write([]byte(out))
-
-			if token == binding.TokenEos() {
-				finish = true
-				finishReason = "stop"
-			} else if outTokenNum >= maxTokens || promptTokenNum+outTokenNum >= l.Model.ContextSize() {
-				finish = true
-				finishReason = "length"
-			} else if ok, _ := matchAnyStop(builder.String(), stops); ok {
-				finish = true
-				finishReason = "stop"
+	choices := make([]ChatCompletionChoice, 0, p.n)
+	for _, c := range bestChoices(candidates, p.n) {
+		message := ChatCompletionMessage{
+			Role:    AssistantRole,
+			Content: c.text,
+		}
+		finishReason := c.finishReason
+		if toolCallsEnabled(p) {
+			if toolCalls, ok := parseToolCalls(c.text, p.tools); ok {
+				message.Content = ""
+				message.ToolCalls = toolCalls
+				finishReason = "tool_calls"
 			}
 		}
+		choice := ChatCompletionChoice{Index: c.index, Message: message, FinishReason: finishReason, Incomplete: c.incomplete}
+		if p.logprobs {
+			choice.Logprobs = chatCompletionLogprobs(c.logprobs)
+		}
+		choices = append(choices, choice)
 	}
 
-	text := builder.String()
-
-	message := ChatCompletionMessage{
-		Role:    AssistantRole,
-		Content: text,
-	}
-
-	choice := ChatCompletionChoice{Index: 0, Message: message, FinishReason: finishReason}
-
 	completion := &ChatCompletion{}
 	completion.Created = int(time.Now().Unix())
 	completion.ID = string(uuid.NewUUID())
 	completion.Model = l.modelConfig.Name
 	completion.Object = "chat.completion"
-	completion.Choices = []ChatCompletionChoice{choice}
+	completion.Choices = choices
 	completion.Usage.PromptTokens = promptTokenNum
 	completion.Usage.CompletionTokens = outTokenNum
 	completion.Usage.TotalTokens = promptTokenNum + outTokenNum
+	completion.Usage.PromptTokensDetails.CachedTokens = matchNum
+	completion.Usage.CompletionTokensDetails.AcceptedPredictionTokens = acceptedNum
+	completion.Usage.CompletionTokensDetails.RejectedPredictionTokens = draftedNum - acceptedNum
 
-	similar := float32(float32(matchNum) / float32(outTokenNum+promptTokenNum))
-	needSave := similar < l.modelConfig.Session.Threshold
-	if needSave {
-		err := l.Model.SaveSession(sessionFilepath)
-		if err != nil {
-			klog.Errorf("failed to save session, err: %v", err)
-			return nil, err
-		}
+	if err := l.saveSession(id, sessionNum); err != nil {
+		return nil, err
 	}
 
 	return completion, nil
 }
 
-func (l *llm) ChatCompletionStream(ctx context.Context, id string, input []ChatCompletionMessage, maxTokens int, stops []string, outChan chan *ChatCompletionChunk, opts ...model.SampleOption) error {
+func (l *llm) ChatCompletionStream(ctx context.Context, id string, input []ChatCompletionMessage, maxTokens int, stops []string, outChan chan *ChatCompletionChunk, opts ...Option) error {
+	p := newParams(opts...)
+
 	l.locker.Lock()
 	defer l.locker.Unlock()
 
@@ -143,85 +109,34 @@ func (l *llm) ChatCompletionStream(ctx context.Context, id string, input []ChatC
 		stops = append(stops, l.modelConfig.Stops...)
 	}
 
-	promptTemplate := l.templates["chat"]
-
-	renderedPrompt, err := render(promptTemplate, input)
-	if err != nil {
-		klog.Errorf("failed to render prompt template: %v, input: %v, err: %v", promptTemplate, input, err)
+	if err := applyToolChoice(p); err != nil {
 		return err
 	}
 
-	klog.V(3).Infof("rendered prompt: %v", renderedPrompt)
-
-	promptTokens, err := l.Tokenize(renderedPrompt, true)
+	promptTokens, err := l.fitChatPrompt(ctx, input, maxTokens, p)
 	if err != nil {
-		klog.Errorf("failed to tokenize, prompt: %+v, err: %v", renderedPrompt, err)
 		return err
 	}
 
-	promptTokenNum := len(promptTokens)
-
-	if promptTokenNum >= *l.modelConfig.Context {
-		return fmt.Errorf("tokens exceeds max context size: %d", *l.modelConfig.Context)
+	if err := l.tokenizeNegativeChatPrompt(input, p); err != nil {
+		return err
 	}
 
-	l.Reset()
 	if l.modelConfig.Verbose {
 		defer l.Model.PrintTimings()
 	}
 
-	sessionFilepath := l.generateSessionFilepath(id)
-
-	matchNum := 0
-	if l.modelConfig.Session.Enable {
-		matchNum, err = l.Model.LoadSession(sessionFilepath, promptTokens)
-		if err != nil {
-			klog.Errorf("failed to load session, err: %v", err)
-			return err
-		}
-		klog.V(3).Infof("session %s state found, match token num: %d", id, matchNum)
-		promptTokens = promptTokens[matchNum:]
-		klog.V(3).Infof("current prompt tokens num: %d", len(promptTokens))
-	}
+	matchNum, sessionNum := l.restoreSession(id, promptTokens)
 
 	uid := string(uuid.NewUUID())
 	created := int(time.Now().Unix())
 
-	tokenGenerator := l.generate(promptTokens, opts...)
-
-	outTokenNum := 0
-
-	builder := strings.Builder{}
-	finish := false
-	for !finish {
-		token, err := tokenGenerator()
-		if err != nil {
-			klog.Errorf("failed to generate, token: %v, err: %v", token, err)
-			return err
+	send := func(c *choice, delta ChatCompletionChunkDelta, finishReason string) error {
+		choice := ChatCompletionChunkChoice{Index: c.index, Delta: delta, FinishReason: finishReason, Incomplete: c.incomplete}
+		if p.logprobs {
+			choice.Logprobs = chatCompletionLogprobs(c.flushLogprobs())
 		}
 
-		outTokenNum++
-		out := l.Detokenize([]binding.Token{token})
-		klog.V(4).Infof("got token %d, out: %v", token, out)
-		builder.Write([]byte(out))
-
-		finishReason := ""
-		if token == binding.TokenEos() {
-			finish = true
-			finishReason = "stop"
-		} else if outTokenNum >= maxTokens || promptTokenNum+outTokenNum >= l.Model.ContextSize() {
-			finish = true
-			finishReason = "length"
-		} else if ok, _ := matchAnyStop(builder.String(), stops); ok {
-			finish = true
-			finishReason = "stop"
-		}
-
-		choice := ChatCompletionChunkChoice{Index: 0, Delta: ChatCompletionChunkDelta{
-			Role:    AssistantRole,
-			Content: out,
-		}, FinishReason: finishReason}
-
 		chunck := &ChatCompletionChunk{}
 		chunck.ID = uid
 		chunck.Created = created
@@ -234,16 +149,178 @@ func (l *llm) ChatCompletionStream(ctx context.Context, id string, input []ChatC
 			return ctx.Err()
 		case outChan <- chunck:
 		}
+		return nil
+	}
+
+	// output is held back until it is known whether a choice is a message or tool calls
+	buffers := map[int]*toolCallsBuffer{}
+
+	handler := func(c *choice, out string) error {
+		if !toolCallsEnabled(p) {
+			return send(c, ChatCompletionChunkDelta{Role: AssistantRole, Content: out}, c.finishReason)
+		}
+
+		buffer, ok := buffers[c.index]
+		if !ok {
+			buffer = &toolCallsBuffer{forced: toolCallsForced(p)}
+			buffers[c.index] = buffer
+		}
+
+		text, isToolCalls, ready := buffer.write(out, c.finishReason != "")
+		if !ready {
+			return nil
+		}
+
+		if isToolCalls {
+			if toolCalls, ok := parseToolCalls(text, p.tools); ok {
+				for i := range toolCalls {
+					index := i
+					toolCalls[i].Index = &index
+				}
+				return send(c, ChatCompletionChunkDelta{Role: AssistantRole, ToolCalls: toolCalls}, "tool_calls")
+			}
+		}
+		return send(c, ChatCompletionChunkDelta{Role: AssistantRole, Content: text}, c.finishReason)
+	}
+
+	// choices are streamed one after another by index, candidates can not be ranked before they are sent, so best
+	// of greater than n is rejected in stream
+	if _, err := l.generateChoices(ctx, promptTokens, matchNum, p.n, maxTokens, stops, handler, p); err != nil {
+		return err
+	}
+	l.cachePrefix(promptTokens, matchNum)
+	return l.saveSession(id, sessionNum)
+}
+
+func (l *llm) tokenizeChatPrompt(input []ChatCompletionMessage, tools []Tool) ([]binding.Token, error) {
+	promptTemplate := l.templates["chat"]
+
+	renderedPrompt, err := render(promptTemplate, input, tools)
+	if err != nil {
+		klog.Errorf("failed to render prompt template: %v, input: %v, err: %v", promptTemplate, input, err)
+		return nil, err
+	}
+
+	klog.V(3).Infof("rendered prompt: %v", renderedPrompt)
+
+	promptTokens, err := l.Tokenize(renderedPrompt, true)
+	if err != nil {
+		klog.Errorf("failed to tokenize, prompt: %+v, err: %v", renderedPrompt, err)
+		return nil, err
+	}
+	return promptTokens, nil
+}
+
+// restoreSession prepares context for prompt of session id, and returns the number of prompt tokens already
+// evaluated, and how many of them are restored from state of the session. Evaluated tokens are reused when the
+// context holds state of the session, otherwise the longest prefix among context, stored state of the session
+// and prefix cache is restored.
+func (l *llm) restoreSession(id string, promptTokens []binding.Token) (matchNum, sessionNum int) {
+	if !l.sessionEnabled() || id == "" || l.session != id {
+		matchNum = l.reuseContext(promptTokens)
+		if n := l.loadSession(id, promptTokens, matchNum); n != matchNum {
+			matchNum, sessionNum = n, n
+		}
+		return l.loadPrefix(promptTokens, matchNum), sessionNum
+	}
+
+	matchNum = commonPrefix(l.Tokens(), promptTokens)
+	l.Rewind(matchNum)
+	klog.V(3).Infof("session %s state held by context, match token num: %d", id, matchNum)
+	return matchNum, matchNum
+}
+
+func (l *llm) Sessions() ([]session.Info, error) {
+	if l.sessions == nil {
+		return nil, nil
+	}
+	return l.sessions.List()
+}
+
+func (l *llm) Session(id string) (*session.Info, error) {
+	if l.sessions == nil {
+		return nil, session.ErrNotFound
 	}
+	return l.sessions.Stat(id)
+}
 
-	similar := float32(float32(matchNum) / float32(outTokenNum+promptTokenNum))
-	needSave := similar < l.modelConfig.Session.Threshold
-	if needSave {
-		err := l.Model.SaveSession(sessionFilepath)
-		if err != nil {
-			klog.Errorf("failed to save session, err: %v", err)
-			return err
+func (l *llm) EndSession(id string) error {
+	if l.session == id {
+		l.session = ""
+	}
+	if l.sessions == nil {
+		return nil
+	}
+	return l.sessions.Delete(id)
+}
+
+func (l *llm) sessionEnabled() bool {
+	return l.modelConfig.Session.Enable && l.sessions != nil
+}
+
+// loadSession restores context from stored state of session if it shares more tokens with prompt than matchNum
+// evaluated by context, and returns the number of prompt tokens evaluated. A state which can not be loaded is
+// ignored.
+func (l *llm) loadSession(id string, promptTokens []binding.Token, matchNum int) int {
+	if !l.sessionEnabled() || id == "" {
+		return matchNum
+	}
+	state, err := l.sessions.Get(id)
+	if errors.Is(err, session.ErrCorrupt) {
+		klog.Errorf("session %s is discarded, err: %v", id, err)
+		if err := l.sessions.Delete(id); err != nil {
+			klog.Errorf("failed to delete session %s, err: %v", id, err)
+		}
+		return matchNum
+	}
+	if err != nil {
+		if err != session.ErrNotFound {
+			klog.Errorf("failed to load session %s, err: %v", id, err)
 		}
+		return matchNum
+	}
+	if commonPrefix(state.Tokens, promptTokens) <= matchNum {
+		return matchNum
+	}
+	matchNum = l.Model.LoadState(state, promptTokens)
+	klog.V(3).Infof("session %s state found, match token num: %d", id, matchNum)
+	klog.V(3).Infof("current prompt tokens num: %d", len(promptTokens)-matchNum)
+	return matchNum
+}
+
+func (l *llm) saveSession(id string, matchNum int) error {
+	if !l.sessionEnabled() || id == "" {
+		return nil
+	}
+	// the context holds state of the session, until it is reset. Only the last generated choice is left in it.
+	l.session = id
+	similar := float32(float32(matchNum) / float32(len(l.Tokens())))
+	if similar >= l.modelConfig.Session.Threshold {
+		return nil
+	}
+	return l.putSession(id)
+}
+
+// storeHeldSession stores state of the session held by context before the context is reused for another prompt,
+// because saveSession skips states similar to the stored one. The session is held again when it is saved after
+// its chat is generated.
+func (l *llm) storeHeldSession() error {
+	if !l.sessionEnabled() || l.session == "" {
+		return nil
+	}
+	return l.putSession(l.session)
+}
+
+// putSession stores state of context as state of session id
+func (l *llm) putSession(id string) error {
+	state, err := l.Model.SaveState()
+	if err != nil {
+		klog.Errorf("failed to save session state, err: %v", err)
+		return err
+	}
+	if err := l.sessions.Put(id, state); err != nil {
+		klog.Errorf("failed to save session, err: %v", err)
+		return err
 	}
 	return nil
 }
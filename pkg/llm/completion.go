@@ -3,21 +3,20 @@ package llm
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/klog/v2"
 
 	"github.com/bdqfork/go-llama.cpp/pkg/binding"
-	"github.com/bdqfork/go-llama.cpp/pkg/model"
 )
 
-func (l *llm) Completion(ctx context.Context, prompt string, stops []string, suffix string, maxTokens int, echo bool, opts ...model.SampleOption) (*Completion, error) {
+func (l *llm) Completion(ctx context.Context, prompts []string, stops []string, suffix string, maxTokens int, echo bool, opts ...Option) (*Completion, error) {
+	p := newParams(opts...)
+
 	l.locker.Lock()
 	defer l.locker.Unlock()
 
-	l.Reset()
 	if l.modelConfig.Verbose {
 		defer l.Model.PrintTimings()
 	}
@@ -26,90 +25,77 @@ func (l *llm) Completion(ctx context.Context, prompt string, stops []string, suf
 		stops = append(stops, l.modelConfig.Stops...)
 	}
 
-	promptTemplate := l.templates["completion"]
-	input := prompt
-
-	renderedPrompt, err := render(promptTemplate, input)
+	promptsTokens, err := l.tokenizeCompletionPrompts(prompts, maxTokens, p)
 	if err != nil {
-		klog.Errorf("failed to render prompt template: %v, input: %v, err: %v", promptTemplate, input, err)
 		return nil, err
 	}
 
-	klog.V(3).Infof("rendered prompt: %v", renderedPrompt)
-
-	promptTokens, err := l.Tokenize(renderedPrompt, true)
-	if err != nil {
-		klog.Errorf("failed to tokenize, prompt: %+v, err: %v", renderedPrompt, err)
+	if err := l.tokenizeNegativePrompt(p); err != nil {
 		return nil, err
 	}
 
-	promptTokenNum := len(promptTokens)
-
-	if promptTokenNum+maxTokens > *l.modelConfig.Context {
-		return nil, fmt.Errorf("tokens exceeds max context size: %d", *l.modelConfig.Context)
-	}
+	choices := make([]CompletionChoice, 0, len(prompts)*p.n)
+	promptTokenNum := 0
+	cachedTokenNum := 0
+	outTokenNum := 0
+	draftedNum, acceptedNum := 0, 0
+	for i, promptTokens := range promptsTokens {
+		matchNum := l.restorePrefix(promptTokens)
 
-	tokenGenerator := l.generate(promptTokens, opts...)
+		candidates, err := l.generateChoices(ctx, promptTokens, matchNum, p.bestOf, maxTokens, stops, nil, p)
+		if err != nil {
+			return nil, err
+		}
+		l.cachePrefix(promptTokens, matchNum)
+
+		promptTokenNum += len(promptTokens)
+		cachedTokenNum += matchNum
+		for _, c := range candidates {
+			outTokenNum += len(c.tokens)
+			draftedNum += c.draftedNum
+			acceptedNum += c.acceptedNum
+		}
 
-	builder := strings.Builder{}
+		input := prompts[i]
+		for _, c := range bestChoices(candidates, p.n) {
+			text := c.text
+			offset := 0
 
-	finish := false
-	finishReason := ""
-	outTokenNum := 0
+			if echo {
+				text = input + text
+				offset = len(input)
+			}
 
-	for !finish {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			token, err := tokenGenerator()
-			if err != nil {
-				klog.Errorf("failed to generate, token: %v, err: %v", token, err)
-				return nil, err
+			if suffix != "" {
+				text += suffix
 			}
-			outTokenNum++
-			out := l.Detokenize([]binding.Token{token})
-			klog.V(4).Infof("got token %d, out: %v", token, out)
-
-			builder.WriteString(out)
-			if token == binding.TokenEos() {
-				finish = true
-				finishReason = "stop"
-			} else if outTokenNum >= maxTokens || promptTokenNum+outTokenNum >= l.Model.ContextSize() {
-				finish = true
-				finishReason = "length"
-			} else if ok, _ := matchAnyStop(builder.String(), stops); ok {
-				finish = true
-				finishReason = "stop"
+
+			choice := CompletionChoice{Index: i*p.n + c.index, Text: text, FinishReason: c.finishReason, Incomplete: c.incomplete}
+			if p.logprobs {
+				choice.Logprobs = completionLogprobs(c.logprobs, offset)
 			}
+			choices = append(choices, choice)
 		}
 	}
 
-	text := builder.String()
-
-	if echo {
-		text = input + text
-	}
-
-	if suffix != "" {
-		text += suffix
-	}
-
-	choice := CompletionChoice{Index: 0, Text: text, FinishReason: finishReason}
-
 	completion := &Completion{}
 	completion.Created = int(time.Now().Unix())
 	completion.ID = string(uuid.NewUUID())
 	completion.Model = l.modelConfig.Name
 	completion.Object = "text_completion"
-	completion.Choices = []CompletionChoice{choice}
+	completion.Choices = choices
 	completion.Usage.PromptTokens = promptTokenNum
 	completion.Usage.CompletionTokens = outTokenNum
 	completion.Usage.TotalTokens = promptTokenNum + outTokenNum
+	completion.Usage.PromptTokensDetails.CachedTokens = cachedTokenNum
+	completion.Usage.CompletionTokensDetails.AcceptedPredictionTokens = acceptedNum
+	completion.Usage.CompletionTokensDetails.RejectedPredictionTokens = draftedNum - acceptedNum
 	return completion, nil
 }
 
-func (l *llm) CompletionStream(ctx context.Context, prompt string, stops []string, maxTokens int, outChan chan *CompletionChunk, opts ...model.SampleOption) error {
+func (l *llm) CompletionStream(ctx context.Context, prompts []string, stops []string, maxTokens int, outChan chan *CompletionChunk, opts ...Option) error {
+	p := newParams(opts...)
+
 	l.locker.Lock()
 	defer l.locker.Unlock()
 
@@ -119,81 +105,94 @@ func (l *llm) CompletionStream(ctx context.Context, prompt string, stops []strin
 		stops = append(stops, l.modelConfig.Stops...)
 	}
 
-	promptTemplate := l.templates["completion"]
-	input := prompt
-	renderedPrompt, err := render(promptTemplate, input)
+	promptsTokens, err := l.tokenizeCompletionPrompts(prompts, maxTokens, p)
 	if err != nil {
-		klog.Errorf("failed to render prompt template: %v, input: %v, err: %v", promptTemplate, input, err)
 		return err
 	}
 
-	klog.V(3).Infof("rendered prompt: %v", renderedPrompt)
-
-	tokens, err := l.Tokenize(renderedPrompt, true)
-	if err != nil {
-		klog.Errorf("failed to tokenize, prompt: %+v, err: %v", renderedPrompt, err)
+	if err := l.tokenizeNegativePrompt(p); err != nil {
 		return err
 	}
 
-	promptTokenNum := len(tokens)
-
-	if promptTokenNum+maxTokens > *l.modelConfig.Context {
-		return fmt.Errorf("tokens exceeds max context size: %d", *l.modelConfig.Context)
-	}
-
-	tokenGenerator := l.generate(tokens, opts...)
-
-	l.Reset()
 	if l.modelConfig.Verbose {
 		defer l.Model.PrintTimings()
 	}
 
-	builder := strings.Builder{}
-
 	id := string(uuid.NewUUID())
 	created := int(time.Now().Unix())
 
-	finish := false
-	outTokenNum := 0
-	for !finish {
-		token, err := tokenGenerator()
-		if err != nil {
-			klog.Errorf("failed to generate, token: %v, err: %v", token, err)
+	for i, tokens := range promptsTokens {
+		matchNum := l.restorePrefix(tokens)
+
+		promptIndex := i
+		handler := func(c *choice, out string) error {
+			choice := CompletionChoice{Index: promptIndex*p.n + c.index, Text: out, FinishReason: c.finishReason, Incomplete: c.incomplete}
+			if p.logprobs {
+				choice.Logprobs = completionLogprobs(c.flushLogprobs(), 0)
+			}
+
+			chunck := &CompletionChunk{}
+			chunck.ID = id
+			chunck.Created = created
+			chunck.Model = l.modelConfig.Name
+			chunck.Object = "text_completion"
+			chunck.Choices = []CompletionChoice{choice}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case outChan <- chunck:
+			}
+			return nil
+		}
+
+		// choices are streamed one after another by index, candidates can not be ranked before they are sent, so
+		// best of greater than n is rejected in stream
+		if _, err := l.generateChoices(ctx, tokens, matchNum, p.n, maxTokens, stops, handler, p); err != nil {
 			return err
 		}
-		outTokenNum++
-		out := l.Detokenize([]binding.Token{token})
-
-		klog.V(4).Infof("got token %d, out: %v", token, out)
-
-		builder.WriteString(out)
-
-		finishReason := ""
-		if token == binding.TokenEos() {
-			finish = true
-			finishReason = "stop"
-		} else if outTokenNum >= maxTokens || promptTokenNum+outTokenNum >= l.Model.ContextSize() {
-			finish = true
-			finishReason = "length"
-		} else if ok, _ := matchAnyStop(builder.String(), stops); ok {
-			finish = true
-			finishReason = "stop"
+		l.cachePrefix(tokens, matchNum)
+	}
+	return nil
+}
+
+// tokenizeCompletionPrompts tokenizes all prompts before generation, so that an invalid prompt fails the request
+// early. Completion does not need to fit context when context is shifted.
+func (l *llm) tokenizeCompletionPrompts(prompts []string, maxTokens int, p *params) ([][]binding.Token, error) {
+	promptsTokens := make([][]binding.Token, 0, len(prompts))
+	for _, prompt := range prompts {
+		tokens, err := l.tokenizeCompletionPrompt(prompt)
+		if err != nil {
+			return nil, err
 		}
 
-		choice := CompletionChoice{Index: 0, Text: out, FinishReason: finishReason}
+		if p.contextShift && len(tokens) < *l.modelConfig.Context {
+			promptsTokens = append(promptsTokens, tokens)
+			continue
+		}
+		if len(tokens)+maxTokens > *l.modelConfig.Context {
+			return nil, fmt.Errorf("tokens exceeds max context size: %d", *l.modelConfig.Context)
+		}
+		promptsTokens = append(promptsTokens, tokens)
+	}
+	return promptsTokens, nil
+}
 
-		chunck := &CompletionChunk{}
-		chunck.ID = id
-		chunck.Created = created
-		chunck.Model = l.modelConfig.Name
-		chunck.Object = "text_completion"
-		chunck.Choices = []CompletionChoice{choice}
+func (l *llm) tokenizeCompletionPrompt(input string) ([]binding.Token, error) {
+	promptTemplate := l.templates["completion"]
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case outChan <- chunck:
-		}
+	renderedPrompt, err := render(promptTemplate, input, nil)
+	if err != nil {
+		klog.Errorf("failed to render prompt template: %v, input: %v, err: %v", promptTemplate, input, err)
+		return nil, err
 	}
-	return nil
+
+	klog.V(3).Infof("rendered prompt: %v", renderedPrompt)
+
+	tokens, err := l.Tokenize(renderedPrompt, true)
+	if err != nil {
+		klog.Errorf("failed to tokenize, prompt: %+v, err: %v", renderedPrompt, err)
+		return nil, err
+	}
+	return tokens, nil
 }
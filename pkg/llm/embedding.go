@@ -19,7 +19,7 @@ func (l *llm) GetEmbedding(ctx context.Context, inputs []string) (*Embedding, er
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		default:
-			l.Model.Reset()
+			l.Reset()
 
 			tokens, err := l.Model.Tokenize(input, true)
 			if err != nil {
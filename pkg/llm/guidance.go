@@ -0,0 +1,86 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+var (
+	errGuidanceDisabled   = errors.New("guidance is not enabled for model")
+	errBeamSearchGuidance = errors.New("beam search does not support negative prompt")
+)
+
+// guide feeds the guidance context with negative prompt and then generated tokens, so that logits of both
+// contexts are of the same generated tokens
+type guide struct {
+	m model.Model
+	// tokens is tokens to evaluate on next eval
+	tokens  []binding.Token
+	keepNum int
+}
+
+// newGuide prepares guidance context for negative prompt of p, evaluated tokens shared with it are reused
+func (l *llm) newGuide(p *params) *guide {
+	matchNum := commonPrefix(l.guidance.Tokens(), p.guidanceTokens)
+	l.guidance.Rewind(matchNum)
+	keepNum := -1
+	if p.contextShift {
+		keepNum = l.shiftKeepNum(p.keepNum, len(p.guidanceTokens))
+	}
+	return &guide{m: l.guidance, tokens: p.guidanceTokens[matchNum:], keepNum: keepNum}
+}
+
+func (g *guide) eval() error {
+	if g.keepNum >= 0 && len(g.m.Tokens())+len(g.tokens) > g.m.ContextSize() {
+		if err := g.m.Shift(g.keepNum); err != nil {
+			return err
+		}
+	}
+	return g.m.Eval(g.tokens)
+}
+
+// tokenizeNegativePrompt tokenizes negative prompt of completion
+func (l *llm) tokenizeNegativePrompt(p *params) error {
+	if p.negativePrompt == "" {
+		return nil
+	}
+	tokens, err := l.Tokenize(p.negativePrompt, true)
+	if err != nil {
+		return err
+	}
+	return l.setGuidanceTokens(p, tokens)
+}
+
+// tokenizeNegativeChatPrompt tokenizes negative prompt of chat completion, which is rendered as the system message
+// in place of system messages of input
+func (l *llm) tokenizeNegativeChatPrompt(input []ChatCompletionMessage, p *params) error {
+	if p.negativePrompt == "" {
+		return nil
+	}
+	systemRole := l.role(SystemRole)
+	messages := []ChatCompletionMessage{{Role: systemRole, Content: p.negativePrompt}}
+	for _, message := range input {
+		if message.Role != systemRole {
+			messages = append(messages, message)
+		}
+	}
+	tokens, err := l.tokenizeChatPrompt(messages, p.tools)
+	if err != nil {
+		return err
+	}
+	return l.setGuidanceTokens(p, tokens)
+}
+
+func (l *llm) setGuidanceTokens(p *params, tokens []binding.Token) error {
+	if l.guidance == nil {
+		return errGuidanceDisabled
+	}
+	if len(tokens) >= l.guidance.ContextSize() {
+		return fmt.Errorf("negative prompt tokens exceeds context size: %d", l.guidance.ContextSize())
+	}
+	p.guidanceTokens = tokens
+	return nil
+}
@@ -3,8 +3,6 @@ package llm
 import (
 	"context"
 	"io"
-
-	"github.com/bdqfork/go-llama.cpp/pkg/model"
 )
 
 // LLM provides language related operations, based on model
@@ -14,10 +12,15 @@ type LLM interface {
 	// GetEmbedding returns embedding vector of inputs
 	GetEmbedding(ctx context.Context, inputs []string) (*Embedding, error)
 
-	Completion(ctx context.Context, prompt string, stops []string, suffix string, maxTokens int, echo bool, opts ...model.SampleOption) (*Completion, error)
-	CompletionStream(ctx context.Context, prompt string, stops []string, maxTokens int, outChan chan *CompletionChunk, opts ...model.SampleOption) error
+	// Completion returns completions for prompts, choices of the i-th prompt start at index i*n
+	Completion(ctx context.Context, prompts []string, stops []string, suffix string, maxTokens int, echo bool, opts ...Option) (*Completion, error)
+	// CompletionStream returns completions for prompts via stream
+	CompletionStream(ctx context.Context, prompts []string, stops []string, maxTokens int, outChan chan *CompletionChunk, opts ...Option) error
 	// ChatCompletion returns completion for input
-	ChatCompletion(ctx context.Context, id string, input []ChatCompletionMessage, stops []string, maxTokens int, opts ...model.SampleOption) (*ChatCompletion, error)
+	ChatCompletion(ctx context.Context, id string, input []ChatCompletionMessage, stops []string, maxTokens int, opts ...Option) (*ChatCompletion, error)
 	// ChatCompletionStream returns completion for input via stream
-	ChatCompletionStream(ctx context.Context, id string, input []ChatCompletionMessage, maxTokens int, stops []string, outChan chan *ChatCompletionChunk, opts ...model.SampleOption) error
+	ChatCompletionStream(ctx context.Context, id string, input []ChatCompletionMessage, maxTokens int, stops []string, outChan chan *ChatCompletionChunk, opts ...Option) error
+
+	// EndSession ends chat session id, its state is freed
+	EndSession(id string) error
 }
@@ -1,7 +1,7 @@
 package llm
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"sync"
 	"text/template"
@@ -11,11 +11,26 @@ import (
 	"github.com/bdqfork/go-llama.cpp/pkg/binding"
 	"github.com/bdqfork/go-llama.cpp/pkg/config"
 	"github.com/bdqfork/go-llama.cpp/pkg/model"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
 )
 
 type llm struct {
 	model.Model
 	locker sync.Mutex
+	// session is the id of chat session whose state is held by context
+	session string
+	// sessions stores session states, nil if unavailable
+	sessions session.Store
+	// ownSessions is true when sessions is created by the llm, rather than shared
+	ownSessions bool
+	// prefixes caches snapshots of prompt prefixes, nil if disabled
+	prefixes *prefixCache
+	// summaries caches summaries of truncated chat history
+	summaries *summaryCache
+	// speculator drafts tokens with a smaller model, nil if disabled
+	speculator *speculator
+	// guidance is the context evaluating negative prompts, nil if disabled
+	guidance model.Model
 
 	modelConfig *config.ModelConfig
 	templates   map[string]*template.Template
@@ -23,6 +38,16 @@ type llm struct {
 
 // New returns a new LLM instance
 func New(model model.Model, modelConfig *config.ModelConfig) LLM {
+	sessions, err := session.New(modelConfig)
+	if err != nil {
+		klog.Errorf("failed to create session store, sessions are disabled, err: %v", err)
+	}
+	l := newLLM(model, modelConfig, sessions, newPrefixCache(modelConfig.PrefixCache), newSummaryCache())
+	l.ownSessions = sessions != nil
+	return l
+}
+
+func newLLM(model model.Model, modelConfig *config.ModelConfig, sessions session.Store, prefixes *prefixCache, summaries *summaryCache) *llm {
 	templates := make(map[string]*template.Template)
 	for k, v := range modelConfig.PromptTemplates {
 		data, err := os.ReadFile(v)
@@ -30,29 +55,254 @@ func New(model model.Model, modelConfig *config.ModelConfig) LLM {
 			klog.Errorf("failed to read prompt template: %v, err: %v", v, err)
 			panic(err)
 		}
-		templates[k] = template.Must(template.New(k).Parse(string(data)))
+		templates[k] = template.Must(template.New(k).Funcs(templateFuncs).Parse(string(data)))
 	}
-	return &llm{Model: model, modelConfig: modelConfig, templates: templates}
+	return &llm{Model: model, modelConfig: modelConfig, templates: templates, sessions: sessions, prefixes: prefixes, summaries: summaries}
 }
 
 func (l *llm) Close() error {
+	if l.ownSessions {
+		if err := l.sessions.Close(); err != nil {
+			klog.Errorf("failed to close session store, err: %v", err)
+		}
+	}
+	if l.speculator != nil {
+		if err := l.speculator.draft.Close(); err != nil {
+			klog.Errorf("failed to close draft model, err: %v", err)
+		}
+	}
+	if l.guidance != nil {
+		if err := l.guidance.Close(); err != nil {
+			klog.Errorf("failed to close guidance context, err: %v", err)
+		}
+	}
 	return l.Model.Close()
 }
 
-func (l *llm) generate(tokens []binding.Token, opts ...model.SampleOption) func() (binding.Token, error) {
-	next := func() (binding.Token, error) {
+// Reset model context, state of session held by context is dropped
+func (l *llm) Reset() {
+	l.Model.Reset()
+	l.session = ""
+}
+
+// choice is a candidate generated for prompt
+type choice struct {
+	index        int
+	tokens       []binding.Token
+	text         string
+	logprob      float32
+	logprobs     []tokenLogprob
+	finishReason string
+	// incomplete is set when choice is finished by length before its text completes grammar
+	incomplete bool
+	// draftedNum and acceptedNum are the numbers of tokens drafted and kept by speculative decoding
+	draftedNum  int
+	acceptedNum int
+	// flushedNum is the number of logprobs passed to stream
+	flushedNum int
+}
+
+// flushLogprobs returns log probabilities of tokens generated since last flush
+func (c *choice) flushLogprobs() []tokenLogprob {
+	logprobs := c.logprobs[c.flushedNum:]
+	c.flushedNum = len(c.logprobs)
+	return logprobs
+}
+
+// tokenLogprob is log probability of a generated token, offset is its position in text
+type tokenLogprob struct {
+	text    string
+	logprob float32
+	offset  int
+	top     []tokenLogprob
+}
+
+// tokenHandler is called with output of a choice as it is generated, out is text following that of the last call.
+// Output which may be the beginning of a stop sequence is held back, so a call may be for no or several tokens.
+// The last call is made when choice is finished.
+type tokenHandler func(c *choice, out string) error
+
+// generateChoices generates num choices for prompt, the prompt is evaluated once and reused by all choices,
+// matchNum is the number of prompt tokens already evaluated. Choices are generated by beam search instead when
+// it is enabled, which does not stream.
+func (l *llm) generateChoices(ctx context.Context, promptTokens []binding.Token, matchNum, num, maxTokens int, stops []string, handler tokenHandler, p *params) ([]*choice, error) {
+	if p.numBeams > 1 {
+		if handler != nil {
+			return nil, errBeamSearchStream
+		}
+		if p.grammar != nil {
+			return nil, errBeamSearchGrammar
+		}
+		if p.guidanceTokens != nil {
+			return nil, errBeamSearchGuidance
+		}
+		return l.beamSearch(ctx, promptTokens, matchNum, maxTokens, stops, p)
+	}
+	promptTokenNum := len(promptTokens)
+	if p.seed != nil {
+		l.SetSeed(*p.seed)
+	}
+	choices := make([]*choice, 0, num)
+	for i := 0; i < num; i++ {
+		tokens := promptTokens[matchNum:]
+		if i > 0 {
+			// evaluated prompt tokens are reused, at least the last prompt token is evaluated again to restore the
+			// logits of prompt, and more if context is shifted
+			evaluatedNum := commonPrefix(l.Tokens(), promptTokens)
+			l.Rewind(evaluatedNum)
+			tokens = promptTokens[evaluatedNum:]
+		}
+		c, err := l.generateChoice(ctx, i, tokens, promptTokenNum, maxTokens, stops, handler, p)
+		if err != nil {
+			return nil, err
+		}
+		choices = append(choices, c)
+	}
+	return choices, nil
+}
+
+func (l *llm) generateChoice(ctx context.Context, index int, tokens []binding.Token, promptTokenNum, maxTokens int, stops []string, handler tokenHandler, p *params) (*choice, error) {
+	c := &choice{index: index, tokens: make([]binding.Token, 0)}
+
+	opts := p.sampleOptions
+	var grammarState *model.GrammarState
+	if p.grammar != nil {
+		grammarState = p.grammar.NewState()
+		opts = append(opts[:len(opts):len(opts)], model.WithGrammar(grammarState))
+	}
+	var g *guide
+	if p.guidanceTokens != nil {
+		g = l.newGuide(p)
+		opts = append(opts[:len(opts):len(opts)], model.WithGuidance(l.guidance, p.cfgScale))
+	}
+
+	sampler, err := l.NewSampler(opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer sampler.Close()
+	keepNum := -1
+	if p.contextShift {
+		keepNum = l.shiftKeepNum(p.keepNum, promptTokenNum)
+	}
+	tokenGenerator := l.generate(tokens, sampler, keepNum, g)
+	// drafted tokens are verified without guidance
+	if l.speculator != nil && g == nil {
+		draftSampler, err := l.speculator.draft.NewSampler(model.WithTemp(-1))
+		if err != nil {
+			return nil, err
+		}
+		defer draftSampler.Close()
+		tokenGenerator = l.generateSpeculative(tokens, sampler, draftSampler, keepNum, c)
+	}
+
+	output := &stopBuffer{stops: stops}
+	for c.finishReason == "" {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		token, logits, err := tokenGenerator()
+		if err != nil {
+			klog.Errorf("failed to generate, token: %v, err: %v", token, err)
+			return nil, err
+		}
+		c.tokens = append(c.tokens, token)
+		lse := model.LogSumExp(logits)
+		c.logprob += logits[token] - lse
+
+		// text of stop tokens is not part of output
+		stopped := token == binding.TokenEos() || p.stopTokens[token]
+		out := ""
+		if !stopped {
+			out = l.Detokenize([]binding.Token{token})
+		}
+		klog.V(4).Infof("got token %d, out: %v", token, out)
+
+		if p.logprobs {
+			c.logprobs = append(c.logprobs, l.tokenLogprob(logits, lse, token, output.len(), p.topLogprobs))
+		}
+
+		text, found := output.write(out)
+		outTokenNum := len(c.tokens)
+		if stopped || found {
+			c.finishReason = "stop"
+		} else if outTokenNum >= maxTokens || (!p.contextShift && promptTokenNum+outTokenNum >= l.Model.ContextSize()) {
+			c.finishReason = "length"
+			c.incomplete = grammarState != nil && !grammarState.Done()
+		}
+		c.text = text
+
+		if delta, ok := output.next(text, c.finishReason != ""); handler != nil && ok {
+			if err := handler(c, delta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if l.speculator != nil {
+		klog.V(3).Infof("accepted %d of %d drafted tokens, generated tokens: %d", c.acceptedNum, c.draftedNum, len(c.tokens))
+	}
+	return c, nil
+}
+
+// shiftKeepNum returns the number of leading tokens kept by context shift
+func (l *llm) shiftKeepNum(keepNum, promptTokenNum int) int {
+	if keepNum < 0 || keepNum > promptTokenNum {
+		keepNum = promptTokenNum
+	}
+	if keepNum < 1 {
+		keepNum = 1
+	}
+	if keepNum > l.ContextSize()/2 {
+		keepNum = l.ContextSize() / 2
+	}
+	return keepNum
+}
+
+func (l *llm) tokenLogprob(logits []float32, lse float32, token binding.Token, offset, topN int) tokenLogprob {
+	result := tokenLogprob{
+		text:    l.Detokenize([]binding.Token{token}),
+		logprob: logits[token] - lse,
+		offset:  offset,
+	}
+	for _, t := range topLogprobs(logits, topN) {
+		result.top = append(result.top, tokenLogprob{
+			text:    l.Detokenize([]binding.Token{t}),
+			logprob: logits[t] - lse,
+		})
+	}
+	return result
+}
+
+// generate returns a generator of tokens, context is shifted keeping the first keepNum tokens when it is full,
+// negative keepNum disables shift. Generated tokens are fed to guidance context too unless g is nil.
+func (l *llm) generate(tokens []binding.Token, sampler *model.Sampler, keepNum int, g *guide) func() (binding.Token, []float32, error) {
+	next := func() (binding.Token, []float32, error) {
+		if g != nil {
+			if err := g.eval(); err != nil {
+				return 0, nil, err
+			}
+		}
+		if keepNum >= 0 && len(l.Tokens())+len(tokens) > l.ContextSize() {
+			if err := l.Shift(keepNum); err != nil {
+				return 0, nil, err
+			}
+		}
 		err := l.Eval(tokens)
 		if err != nil {
-			return 0, err
+			return 0, nil, err
+		}
+		token, err := sampler.Sample()
+		if err != nil {
+			return 0, nil, err
 		}
-		token := l.Sample(opts...)
 		tokens = []binding.Token{token}
-		return token, nil
+		if g != nil {
+			g.tokens = tokens
+		}
+		return token, sampler.Logits(), nil
 	}
 	return next
 }
-
-func (l *llm) generateSessionFilepath(id string) string {
-	filepath := fmt.Sprintf("%s/%s-%s.dat", l.modelConfig.Session.Path, l.modelConfig.Name, id)
-	return filepath
-}
@@ -0,0 +1,174 @@
+package llm
+
+import (
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+type params struct {
+	n             int
+	bestOf        int
+	logprobs      bool
+	topLogprobs   int
+	grammar       *model.Grammar
+	tools         []Tool
+	toolChoice    ToolChoice
+	seed          *int
+	queueListener func(position int)
+	user          string
+	priority      int
+	truncation    TruncationStrategy
+	lastMessages  int
+	contextShift  bool
+	keepNum       int
+	numBeams      int
+	lengthPenalty float32
+	earlyStopping bool
+	// negativePrompt is tokenized into guidanceTokens before generation
+	negativePrompt string
+	cfgScale       float32
+	guidanceTokens []binding.Token
+	stopTokens     map[binding.Token]bool
+	sampleOptions  []model.SampleOption
+}
+
+// Option for completion and chat completion
+type Option func(*params)
+
+func newParams(opts ...Option) *params {
+	p := &params{n: 1}
+	for _, apply := range opts {
+		apply(p)
+	}
+	if p.n < 1 {
+		p.n = 1
+	}
+	if p.bestOf < p.n {
+		p.bestOf = p.n
+	}
+	return p
+}
+
+// WithN set number of choices to return
+func WithN(n int) Option {
+	return func(p *params) {
+		p.n = n
+	}
+}
+
+// WithBestOf set number of candidates to generate, the best n of them are returned
+func WithBestOf(bestOf int) Option {
+	return func(p *params) {
+		p.bestOf = bestOf
+	}
+}
+
+// WithLogprobs enables log probabilities of generated tokens, with topLogprobs most likely alternatives
+func WithLogprobs(topLogprobs int) Option {
+	return func(p *params) {
+		p.logprobs = true
+		p.topLogprobs = topLogprobs
+	}
+}
+
+// WithGrammar restricts generated text of every choice to grammar
+func WithGrammar(grammar *model.Grammar) Option {
+	return func(p *params) {
+		p.grammar = grammar
+	}
+}
+
+// WithTools set tools model can call, tool choice type defaults to auto
+func WithTools(tools []Tool, toolChoice ToolChoice) Option {
+	return func(p *params) {
+		p.tools = tools
+		p.toolChoice = toolChoice
+		if p.toolChoice.Type == "" {
+			p.toolChoice.Type = ToolChoiceAuto
+		}
+	}
+}
+
+// WithSampleOptions set options used by model sample
+func WithSampleOptions(opts ...model.SampleOption) Option {
+	return func(p *params) {
+		p.sampleOptions = append(p.sampleOptions, opts...)
+	}
+}
+
+// WithSeed set seed of sampling, so that same request generates same choices
+func WithSeed(seed int) Option {
+	return func(p *params) {
+		p.seed = &seed
+	}
+}
+
+// WithQueueListener set listener called with position of request, when it waits in queue for the model
+func WithQueueListener(listener func(position int)) Option {
+	return func(p *params) {
+		p.queueListener = listener
+	}
+}
+
+// WithUser set user of request, queued requests are shared fairly across users
+func WithUser(user string) Option {
+	return func(p *params) {
+		p.user = user
+	}
+}
+
+// WithPriority set priority of request, queued requests of higher priority are admitted first
+func WithPriority(priority int) Option {
+	return func(p *params) {
+		p.priority = priority
+	}
+}
+
+// WithTruncation set strategy removing messages of chat history which exceeds context, lastMessages is the number
+// of messages kept by last messages strategy
+func WithTruncation(strategy TruncationStrategy, lastMessages int) Option {
+	return func(p *params) {
+		p.truncation = strategy
+		p.lastMessages = lastMessages
+	}
+}
+
+// WithContextShift enables generation beyond context size. When context is full, the first keepNum tokens are
+// kept and half of the rest are discarded. Negative keepNum keeps the whole prompt, the first token is always
+// kept, and at most half of context is kept.
+func WithContextShift(keepNum int) Option {
+	return func(p *params) {
+		p.contextShift = true
+		p.keepNum = keepNum
+	}
+}
+
+// WithBeamSearch generates choices by beam search of numBeams beams instead of sampling. Finished sequences are
+// ranked by log probability divided by length to the power of lengthPenalty. With earlyStopping, search stops
+// as soon as numBeams sequences are finished.
+func WithBeamSearch(numBeams int, lengthPenalty float32, earlyStopping bool) Option {
+	return func(p *params) {
+		p.numBeams = numBeams
+		p.lengthPenalty = lengthPenalty
+		p.earlyStopping = earlyStopping
+	}
+}
+
+// WithGuidance steers generation away from negativePrompt by classifier-free guidance of cfgScale, 1 means no
+// guidance. Negative prompt of chat completion is rendered as the system message in place of system messages.
+func WithGuidance(negativePrompt string, cfgScale float32) Option {
+	return func(p *params) {
+		p.negativePrompt = negativePrompt
+		p.cfgScale = cfgScale
+	}
+}
+
+// WithStopTokens stops generation of a choice at any of tokens, whose text is not part of output
+func WithStopTokens(tokens []binding.Token) Option {
+	return func(p *params) {
+		p.stopTokens = make(map[binding.Token]bool, len(tokens))
+		for _, token := range tokens {
+			p.stopTokens[token] = true
+		}
+	}
+}
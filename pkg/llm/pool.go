@@ -0,0 +1,323 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
+)
+
+var (
+	// ErrQueueFull is returned when a request can not wait for the model, because the queue is full
+	ErrQueueFull = errors.New("too many requests waiting for model")
+	// ErrQueueTimeout is returned when a request waits for the model longer than queue timeout
+	ErrQueueTimeout = errors.New("timed out waiting for model")
+)
+
+// pool schedules requests onto llm instances, each of them holds a context of the same model. Requests wait
+// in a bounded queue when all of them are busy.
+type pool struct {
+	llms []*llm
+	busy map[*llm]bool
+	// ended is sessions ended while llm is busy, whose states may be saved again by the running request
+	ended     map[*llm]map[string]bool
+	queue     []*waiter
+	scheduler *scheduler
+	metrics   *queueMetrics
+	// sessions is shared by all llms
+	sessions session.Store
+
+	locker sync.Mutex
+
+	modelConfig *config.ModelConfig
+}
+
+// waiter is a request waiting in queue
+type waiter struct {
+	id       string
+	user     string
+	priority int
+	enqueued time.Time
+	assigned chan *llm
+	listener func(position int)
+}
+
+// NewPool returns a LLM which runs requests concurrently on models, models should be contexts of the same
+// weights. drafts are contexts of the draft model paired with models, nil disables speculative decoding.
+// guidances are contexts of the same weights paired with models evaluating negative prompts, nil disables
+// classifier-free guidance.
+//
+// Session states are kept in sessions, which can be nil and is closed by caller. Queued requests are admitted
+// by policy. A chat session is scheduled onto the model holding its state when the model is free.
+func NewPool(models, drafts, guidances []model.Model, modelConfig *config.ModelConfig, policy SchedulePolicy, sessions session.Store) LLM {
+	p := &pool{
+		sessions:    sessions,
+		busy:        map[*llm]bool{},
+		ended:       map[*llm]map[string]bool{},
+		scheduler:   newScheduler(policy),
+		metrics:     newQueueMetrics(modelConfig.Name),
+		modelConfig: modelConfig,
+	}
+	prefixes := newPrefixCache(modelConfig.PrefixCache)
+	summaries := newSummaryCache()
+	var metrics *draftMetrics
+	if drafts != nil {
+		metrics = newDraftMetrics(modelConfig.Name)
+	}
+	for i, m := range models {
+		l := newLLM(m, modelConfig, sessions, prefixes, summaries)
+		if drafts != nil {
+			l.speculator = newSpeculator(drafts[i], modelConfig.DraftTokens, metrics)
+		}
+		if guidances != nil {
+			l.guidance = guidances[i]
+		}
+		p.llms = append(p.llms, l)
+	}
+	return p
+}
+
+// acquire waits in queue for a free llm, the one holding state of session id is preferred
+func (p *pool) acquire(ctx context.Context, id string, opts []Option) (*llm, error) {
+	queueConfig := p.modelConfig.Queue
+	params := newParams(opts...)
+	w := &waiter{
+		id:       id,
+		user:     params.user,
+		priority: params.priority,
+		enqueued: time.Now(),
+		assigned: make(chan *llm, 1),
+		listener: params.queueListener,
+	}
+
+	p.locker.Lock()
+	if len(p.queue) == 0 {
+		if l := p.pick(id); l != nil {
+			p.busy[l] = true
+			p.metrics.admit(w.priority, 0)
+			p.locker.Unlock()
+			return l, nil
+		}
+	}
+	if queueConfig.MaxDepth > 0 && len(p.queue) >= queueConfig.MaxDepth {
+		p.metrics.rejected.Add("full", 1)
+		p.locker.Unlock()
+		return nil, ErrQueueFull
+	}
+	p.queue = append(p.queue, w)
+	p.metrics.depth.Set(int64(len(p.queue)))
+	// a request of higher priority moves others back in queue
+	waiters := p.notifications()
+	p.locker.Unlock()
+
+	klog.V(3).Infof("request of user %s waits for model %s, priority: %d, queue depth: %d", w.user, p.modelConfig.Name, w.priority, len(waiters))
+	notify(waiters)
+
+	var timeout <-chan time.Time
+	if queueConfig.Timeout > 0 {
+		timer := time.NewTimer(queueConfig.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case l := <-w.assigned:
+		return l, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+
+	p.locker.Lock()
+	removed := p.remove(w)
+	if removed && err == ErrQueueTimeout {
+		p.metrics.rejected.Add("timeout", 1)
+	}
+	waiters = p.notifications()
+	p.locker.Unlock()
+	notify(waiters)
+
+	if !removed {
+		// an llm was assigned before the waiter left queue
+		p.release(<-w.assigned)
+	}
+	return nil, err
+}
+
+func (p *pool) pick(id string) *llm {
+	var free *llm
+	for _, l := range p.llms {
+		if p.busy[l] {
+			continue
+		}
+		if id != "" && l.session == id {
+			return l
+		}
+		if free == nil || (free.session != "" && l.session == "") {
+			// contexts without session state are preferred, so that states of other sessions are kept
+			free = l
+		}
+	}
+	return free
+}
+
+func (p *pool) release(l *llm) {
+	p.locker.Lock()
+	delete(p.busy, l)
+	ended := ""
+	if l.session != "" && p.ended[l][l.session] {
+		ended = l.session
+		l.session = ""
+	}
+	delete(p.ended, l)
+	dispatched := p.dispatch()
+	var waiters []*waiter
+	if dispatched {
+		waiters = p.notifications()
+	}
+	p.locker.Unlock()
+	notify(waiters)
+
+	if ended != "" && p.sessions != nil {
+		if err := p.sessions.Delete(ended); err != nil {
+			klog.Errorf("failed to delete ended session %s, err: %v", ended, err)
+		}
+	}
+}
+
+// dispatch assigns free llms to waiters in order, returns if any waiter is dispatched
+func (p *pool) dispatch() bool {
+	dispatched := false
+	for len(p.queue) > 0 {
+		i := p.scheduler.next(p.queue)
+		w := p.queue[i]
+		l := p.pick(w.id)
+		if l == nil {
+			break
+		}
+		p.busy[l] = true
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		p.scheduler.admitted(w, p.queue)
+		p.metrics.admit(w.priority, time.Since(w.enqueued))
+		w.assigned <- l
+		dispatched = true
+	}
+	p.metrics.depth.Set(int64(len(p.queue)))
+	return dispatched
+}
+
+func (p *pool) remove(w *waiter) bool {
+	for i, queued := range p.queue {
+		if queued == w {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			p.scheduler.prune(p.queue)
+			p.metrics.depth.Set(int64(len(p.queue)))
+			return true
+		}
+	}
+	return false
+}
+
+// notifications returns waiters in admission order, whose positions should be notified
+func (p *pool) notifications() []*waiter {
+	return p.scheduler.order(p.queue)
+}
+
+// notify tells waiters their positions in queue
+func notify(waiters []*waiter) {
+	for i, w := range waiters {
+		if w.listener != nil {
+			w.listener(i + 1)
+		}
+	}
+}
+
+func (p *pool) GetEmbedding(ctx context.Context, inputs []string) (*Embedding, error) {
+	l, err := p.acquire(ctx, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(l)
+	return l.GetEmbedding(ctx, inputs)
+}
+
+func (p *pool) Completion(ctx context.Context, prompts []string, stops []string, suffix string, maxTokens int, echo bool, opts ...Option) (*Completion, error) {
+	l, err := p.acquire(ctx, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(l)
+	return l.Completion(ctx, prompts, stops, suffix, maxTokens, echo, opts...)
+}
+
+func (p *pool) CompletionStream(ctx context.Context, prompts []string, stops []string, maxTokens int, outChan chan *CompletionChunk, opts ...Option) error {
+	l, err := p.acquire(ctx, "", opts)
+	if err != nil {
+		close(outChan)
+		return err
+	}
+	defer p.release(l)
+	return l.CompletionStream(ctx, prompts, stops, maxTokens, outChan, opts...)
+}
+
+func (p *pool) ChatCompletion(ctx context.Context, id string, input []ChatCompletionMessage, stops []string, maxTokens int, opts ...Option) (*ChatCompletion, error) {
+	l, err := p.acquire(ctx, id, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(l)
+	return l.ChatCompletion(ctx, id, input, stops, maxTokens, opts...)
+}
+
+func (p *pool) ChatCompletionStream(ctx context.Context, id string, input []ChatCompletionMessage, maxTokens int, stops []string, outChan chan *ChatCompletionChunk, opts ...Option) error {
+	l, err := p.acquire(ctx, id, opts)
+	if err != nil {
+		close(outChan)
+		return err
+	}
+	defer p.release(l)
+	return l.ChatCompletionStream(ctx, id, input, maxTokens, stops, outChan, opts...)
+}
+
+// EndSession drops state of session id held by contexts and stored in sessions. A context running a request
+// of the session drops it when the request is finished.
+func (p *pool) EndSession(id string) error {
+	p.locker.Lock()
+	for _, l := range p.llms {
+		if p.busy[l] {
+			if p.ended[l] == nil {
+				p.ended[l] = map[string]bool{}
+			}
+			p.ended[l][id] = true
+			continue
+		}
+		if l.session == id {
+			l.session = ""
+		}
+	}
+	p.locker.Unlock()
+
+	if p.sessions == nil {
+		return nil
+	}
+	return p.sessions.Delete(id)
+}
+
+func (p *pool) Close() error {
+	errs := make([]error, 0)
+	for _, l := range p.llms {
+		if err := l.Close(); err != nil {
+			klog.Errorf("failed to close model %s, err: %v", p.modelConfig.Name, err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,237 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
+)
+
+// newTestPool returns a pool of num llms without models, which is enough for scheduling
+func newTestPool(t *testing.T, num int, queueConfig config.QueueConfig, policy SchedulePolicy, sessions session.Store) *pool {
+	p := &pool{
+		sessions:    sessions,
+		busy:        map[*llm]bool{},
+		ended:       map[*llm]map[string]bool{},
+		scheduler:   newScheduler(policy),
+		metrics:     newQueueMetrics(t.Name()),
+		modelConfig: &config.ModelConfig{Name: t.Name(), Queue: queueConfig},
+	}
+	for i := 0; i < num; i++ {
+		p.llms = append(p.llms, &llm{})
+	}
+	return p
+}
+
+// waitQueued waits until num requests wait in queue of p
+func waitQueued(t *testing.T, p *pool, num int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.locker.Lock()
+		depth := len(p.queue)
+		p.locker.Unlock()
+		if depth == num {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d requests in queue", num)
+}
+
+func mustAcquire(t *testing.T, p *pool, id string, opts ...Option) *llm {
+	t.Helper()
+	l, err := p.acquire(context.Background(), id, opts)
+	if err != nil {
+		t.Fatalf("failed to acquire, err: %v", err)
+	}
+	return l
+}
+
+func TestPoolPick(t *testing.T) {
+	p := newTestPool(t, 3, config.QueueConfig{}, ScheduleFIFO, nil)
+	p.llms[0].session = "a"
+	p.llms[2].session = "b"
+
+	if l := mustAcquire(t, p, "b"); l != p.llms[2] {
+		t.Error("expected the llm holding state of session to be picked")
+	}
+	// contexts without session state are preferred, so that states of other sessions are kept
+	if l := mustAcquire(t, p, "c"); l != p.llms[1] {
+		t.Error("expected the llm without session state to be picked")
+	}
+	if l := mustAcquire(t, p, ""); l != p.llms[0] {
+		t.Error("expected the last free llm to be picked")
+	}
+}
+
+func TestPoolQueueRejection(t *testing.T) {
+	cases := []struct {
+		name        string
+		queueConfig config.QueueConfig
+		waiting     int
+		err         error
+	}{
+		{name: "full", queueConfig: config.QueueConfig{MaxDepth: 1}, waiting: 1, err: ErrQueueFull},
+		{name: "timeout", queueConfig: config.QueueConfig{Timeout: 10 * time.Millisecond}, waiting: 0, err: ErrQueueTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestPool(t, 1, c.queueConfig, ScheduleFIFO, nil)
+			busy := mustAcquire(t, p, "")
+
+			results := make(chan error, c.waiting)
+			for i := 0; i < c.waiting; i++ {
+				go func() {
+					l, err := p.acquire(context.Background(), "", nil)
+					if err == nil {
+						p.release(l)
+					}
+					results <- err
+				}()
+			}
+			waitQueued(t, p, c.waiting)
+
+			if _, err := p.acquire(context.Background(), "", nil); !errors.Is(err, c.err) {
+				t.Errorf("expected %v, got: %v", c.err, err)
+			}
+			if rejected := p.metrics.rejected.Get(c.name); rejected == nil || rejected.String() != "1" {
+				t.Errorf("expected one rejection counted as %s, got: %v", c.name, rejected)
+			}
+
+			p.release(busy)
+			for i := 0; i < c.waiting; i++ {
+				if err := <-results; err != nil {
+					t.Errorf("expected queued request to be admitted, got: %v", err)
+				}
+			}
+			waitQueued(t, p, 0)
+		})
+	}
+}
+
+func TestPoolQueueCanceled(t *testing.T) {
+	p := newTestPool(t, 1, config.QueueConfig{}, ScheduleFIFO, nil)
+	busy := mustAcquire(t, p, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := p.acquire(ctx, "", nil)
+		result <- err
+	}()
+	waitQueued(t, p, 1)
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	waitQueued(t, p, 0)
+
+	p.release(busy)
+	if p.busy[busy] {
+		t.Error("expected llm to be free after release")
+	}
+}
+
+func TestPoolDispatchOrder(t *testing.T) {
+	p := newTestPool(t, 1, config.QueueConfig{}, SchedulePriority, nil)
+	busy := mustAcquire(t, p, "")
+
+	admitted := make(chan string, 3)
+	positions := make(chan int, 16)
+	requests := []struct {
+		id       string
+		priority int
+	}{{id: "low", priority: -1}, {id: "default", priority: 0}, {id: "high", priority: 1}}
+	for i, r := range requests {
+		go func(id string, priority int) {
+			l, err := p.acquire(context.Background(), id, []Option{WithPriority(priority), WithQueueListener(func(position int) {
+				if id == "low" {
+					positions <- position
+				}
+			})})
+			if err != nil {
+				t.Errorf("failed to acquire, err: %v", err)
+				admitted <- ""
+				return
+			}
+			admitted <- id
+			p.release(l)
+		}(r.id, r.priority)
+		waitQueued(t, p, i+1)
+	}
+
+	// requests of higher priority move the low one back in queue
+	last := 0
+	for len(positions) > 0 {
+		last = <-positions
+	}
+	if last != 3 {
+		t.Errorf("expected low priority request at position 3, got: %d", last)
+	}
+
+	p.release(busy)
+	order := []string{<-admitted, <-admitted, <-admitted}
+	if expected := []string{"high", "default", "low"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected admission order %v, got: %v", expected, order)
+	}
+}
+
+func TestPoolEndSession(t *testing.T) {
+	sessions := session.NewMemoryStore(1<<20, nil)
+	p := newTestPool(t, 2, config.QueueConfig{}, ScheduleFIFO, sessions)
+	state := &model.State{Tokens: []binding.Token{1}, Data: []byte("state")}
+
+	// a free llm drops the session at once
+	p.llms[1].session = "free"
+	if err := sessions.Put("free", state); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	if err := p.EndSession("free"); err != nil {
+		t.Fatalf("failed to end session, err: %v", err)
+	}
+	if p.llms[1].session != "" {
+		t.Error("expected free llm to drop ended session")
+	}
+
+	// a busy llm may save the session again, which is dropped on release
+	l := mustAcquire(t, p, "busy")
+	if err := p.EndSession("busy"); err != nil {
+		t.Fatalf("failed to end session, err: %v", err)
+	}
+	l.session = "busy"
+	if err := sessions.Put("busy", state); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	p.release(l)
+
+	if l.session != "" {
+		t.Error("expected released llm to drop ended session")
+	}
+	for _, id := range []string{"free", "busy"} {
+		if _, err := sessions.Get(id); !errors.Is(err, session.ErrNotFound) {
+			t.Errorf("expected session %s to be deleted, got: %v", id, err)
+		}
+	}
+	if len(p.ended) != 0 {
+		t.Errorf("expected ended sessions of released llm to be forgotten, got: %v", p.ended)
+	}
+
+	// a session ended without store is dropped from context only
+	p = newTestPool(t, 1, config.QueueConfig{}, ScheduleFIFO, nil)
+	l = mustAcquire(t, p, "")
+	if err := p.EndSession("a"); err != nil {
+		t.Fatalf("failed to end session, err: %v", err)
+	}
+	l.session = "a"
+	p.release(l)
+	if l.session != "" {
+		t.Error("expected released llm to drop ended session")
+	}
+}
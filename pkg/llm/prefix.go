@@ -0,0 +1,157 @@
+package llm
+
+import (
+	"container/list"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// defaultPrefixMinTokens is the min number of newly evaluated prompt tokens worth a snapshot
+const defaultPrefixMinTokens = 64
+
+// prefixCache keeps snapshots of contexts keyed by prompt tokens within a byte budget, so that a prompt sharing
+// a prefix with a cached one skips evaluating it. It is shared by contexts of the same model.
+type prefixCache struct {
+	maxBytes  int64
+	minTokens int
+
+	used   int64
+	lru    *list.List
+	locker sync.Mutex
+}
+
+// newPrefixCache returns nil if cache is disabled
+func newPrefixCache(cacheConfig config.PrefixCacheConfig) *prefixCache {
+	if cacheConfig.MaxBytes <= 0 {
+		return nil
+	}
+	minTokens := cacheConfig.MinTokens
+	if minTokens <= 0 {
+		minTokens = defaultPrefixMinTokens
+	}
+	return &prefixCache{maxBytes: cacheConfig.MaxBytes, minTokens: minTokens, lru: list.New()}
+}
+
+// lookup returns the cached state sharing the longest prefix with tokens, and the length of the prefix
+func (c *prefixCache) lookup(tokens []binding.Token) (*model.State, int) {
+	if c == nil {
+		return nil, 0
+	}
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	var best *list.Element
+	bestNum := 0
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if n := commonPrefix(e.Value.(*model.State).Tokens, tokens); n > bestNum {
+			best, bestNum = e, n
+		}
+	}
+	if best == nil {
+		return nil, 0
+	}
+	c.lru.MoveToFront(best)
+	return best.Value.(*model.State), bestNum
+}
+
+// put caches state, whose tokens are the prompt tokens evaluated by it. Cached states whose tokens are a prefix
+// of them are replaced.
+func (c *prefixCache) put(state *model.State) {
+	size := int64(state.Size())
+	if size > c.maxBytes {
+		return
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		cached := e.Value.(*model.State)
+		if len(cached.Tokens) <= len(state.Tokens) && commonPrefix(cached.Tokens, state.Tokens) == len(cached.Tokens) {
+			c.remove(e)
+		}
+		e = next
+	}
+	c.lru.PushFront(state)
+	c.used += size
+
+	for c.used > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *prefixCache) remove(e *list.Element) {
+	c.used -= int64(e.Value.(*model.State).Size())
+	c.lru.Remove(e)
+}
+
+// commonPrefix returns the number of leading tokens shared by evaluated and prompt, the last prompt token is
+// excluded since it is always evaluated again to get its logits
+func commonPrefix(evaluated, prompt []binding.Token) int {
+	n := 0
+	for n < len(evaluated) && n < len(prompt)-1 && evaluated[n] == prompt[n] {
+		n++
+	}
+	return n
+}
+
+// reuseContext keeps tokens evaluated by context which are shared with prompt, and returns their number. The
+// context no longer holds state of a session.
+func (l *llm) reuseContext(promptTokens []binding.Token) int {
+	l.session = ""
+	matchNum := commonPrefix(l.Tokens(), promptTokens)
+	l.Rewind(matchNum)
+	return matchNum
+}
+
+// restorePrefix prepares context for prompt, and returns the number of prompt tokens already evaluated, which
+// are reused from context or prefix cache
+func (l *llm) restorePrefix(promptTokens []binding.Token) int {
+	matchNum := l.reuseContext(promptTokens)
+	return l.loadPrefix(promptTokens, matchNum)
+}
+
+// loadPrefix loads the cached state if it shares more tokens with prompt than matchNum evaluated by context,
+// and returns the number of prompt tokens evaluated
+func (l *llm) loadPrefix(promptTokens []binding.Token, matchNum int) int {
+	state, cachedNum := l.prefixes.lookup(promptTokens)
+	if state == nil || cachedNum <= matchNum {
+		return matchNum
+	}
+	matchNum = l.Model.LoadState(state, promptTokens)
+	klog.V(3).Infof("prompt prefix found in cache, match token num: %d", matchNum)
+	return matchNum
+}
+
+// cachePrefix snapshots context after prompt is evaluated, unless few prompt tokens are newly evaluated or the
+// prompt is already cached
+func (l *llm) cachePrefix(promptTokens []binding.Token, matchNum int) {
+	if l.prefixes == nil || len(promptTokens)-matchNum < l.prefixes.minTokens {
+		return
+	}
+	if _, cachedNum := l.prefixes.lookup(promptTokens); cachedNum >= len(promptTokens)-1 {
+		return
+	}
+
+	// a context shifted during generation no longer holds the whole prompt
+	evaluatedNum := commonPrefix(l.Tokens(), promptTokens)
+	if evaluatedNum < len(promptTokens)-1 {
+		return
+	}
+
+	state, err := l.Model.SaveState()
+	if err != nil {
+		klog.Errorf("failed to snapshot prompt prefix, err: %v", err)
+		return
+	}
+	// generated tokens are not part of the key, their kv cache is overwritten by the next prompt
+	state.Tokens = state.Tokens[:evaluatedNum:evaluatedNum]
+	l.prefixes.put(state)
+	klog.V(3).Infof("prompt prefix cached, token num: %d", len(promptTokens))
+}
@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// SchedulePolicy decides the order in which queued requests are admitted
+type SchedulePolicy string
+
+const (
+	// ScheduleFIFO admits requests in arrival order
+	ScheduleFIFO SchedulePolicy = "fifo"
+	// SchedulePriority admits requests of higher priority first, then in arrival order
+	SchedulePriority SchedulePolicy = "priority"
+	// ScheduleFair admits requests round robin across users, then in arrival order
+	ScheduleFair SchedulePolicy = "fair"
+	// SchedulePriorityFair admits requests of higher priority first, then round robin across users
+	SchedulePriorityFair SchedulePolicy = "priority-fair"
+)
+
+// ParseSchedulePolicy returns policy by name
+func ParseSchedulePolicy(name string) (SchedulePolicy, error) {
+	switch policy := SchedulePolicy(name); policy {
+	case ScheduleFIFO, SchedulePriority, ScheduleFair, SchedulePriorityFair:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown schedule policy: %s", name)
+}
+
+// schedulerMetrics is published as expvar scheduler, keyed by model name
+var schedulerMetrics = expvar.NewMap("scheduler")
+
+// queueMetrics is metrics of queue of a model
+type queueMetrics struct {
+	// depth is the number of waiting requests
+	depth expvar.Int
+	// admitted is the number of admitted requests by priority
+	admitted expvar.Map
+	// waitSeconds is the total time admitted requests waited by priority
+	waitSeconds expvar.Map
+	// rejected is the number of rejected requests by reason
+	rejected expvar.Map
+}
+
+func newQueueMetrics(name string) *queueMetrics {
+	m := &queueMetrics{}
+	metrics := &expvar.Map{}
+	metrics.Set("depth", &m.depth)
+	metrics.Set("admitted", m.admitted.Init())
+	metrics.Set("wait_seconds", m.waitSeconds.Init())
+	metrics.Set("rejected", m.rejected.Init())
+	schedulerMetrics.Set(name, metrics)
+	return m
+}
+
+func (m *queueMetrics) admit(priority int, waited time.Duration) {
+	key := fmt.Sprint(priority)
+	m.admitted.Add(key, 1)
+	m.waitSeconds.AddFloat(key, waited.Seconds())
+}
+
+// scheduler orders waiters by policy
+type scheduler struct {
+	policy SchedulePolicy
+	// served is the admission sequence of the last admitted request of users who are waiting
+	served map[string]uint64
+	seq    uint64
+}
+
+func newScheduler(policy SchedulePolicy) *scheduler {
+	if policy == "" {
+		policy = ScheduleFIFO
+	}
+	return &scheduler{policy: policy, served: map[string]uint64{}}
+}
+
+// next returns index of the waiter admitted next
+func (s *scheduler) next(queue []*waiter) int {
+	return s.nextOf(queue, s.served)
+}
+
+func (s *scheduler) nextOf(queue []*waiter, served map[string]uint64) int {
+	best := 0
+	for i := 1; i < len(queue); i++ {
+		if s.before(queue[i], queue[best], served) {
+			best = i
+		}
+	}
+	return best
+}
+
+// before returns if a should be admitted before b, queue is in arrival order so ties keep it
+func (s *scheduler) before(a, b *waiter, served map[string]uint64) bool {
+	if s.policy == SchedulePriority || s.policy == SchedulePriorityFair {
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+	}
+	if s.policy == ScheduleFair || s.policy == SchedulePriorityFair {
+		if a.user != b.user {
+			return served[a.user] < served[b.user]
+		}
+	}
+	return false
+}
+
+// admitted records that w is admitted, remaining is the queue without w
+func (s *scheduler) admitted(w *waiter, remaining []*waiter) {
+	s.seq++
+	s.served[w.user] = s.seq
+	s.prune(remaining)
+}
+
+// prune forgets users without waiters, so that a returning user is served before users with backlog
+func (s *scheduler) prune(queue []*waiter) {
+	waiting := map[string]bool{}
+	for _, w := range queue {
+		waiting[w.user] = true
+	}
+	for user := range s.served {
+		if !waiting[user] {
+			delete(s.served, user)
+		}
+	}
+}
+
+// order returns waiters in the order they would be admitted
+func (s *scheduler) order(queue []*waiter) []*waiter {
+	served := make(map[string]uint64, len(s.served))
+	for user, seq := range s.served {
+		served[user] = seq
+	}
+	seq := s.seq
+
+	remaining := append([]*waiter(nil), queue...)
+	ordered := make([]*waiter, 0, len(queue))
+	for len(remaining) > 0 {
+		i := s.nextOf(remaining, served)
+		w := remaining[i]
+		ordered = append(ordered, w)
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		seq++
+		served[w.user] = seq
+	}
+	return ordered
+}
@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestWaiter(id, user string, priority int) *waiter {
+	return &waiter{id: id, user: user, priority: priority, assigned: make(chan *llm, 1)}
+}
+
+func waiterIDs(waiters []*waiter) []string {
+	ids := make([]string, 0, len(waiters))
+	for _, w := range waiters {
+		ids = append(ids, w.id)
+	}
+	return ids
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	queue := []*waiter{
+		newTestWaiter("a1", "a", 0),
+		newTestWaiter("a2", "a", 0),
+		newTestWaiter("b1", "b", 1),
+		newTestWaiter("a3", "a", 1),
+		newTestWaiter("c1", "c", -1),
+		newTestWaiter("b2", "b", 0),
+	}
+	cases := []struct {
+		policy SchedulePolicy
+		order  []string
+	}{
+		{policy: ScheduleFIFO, order: []string{"a1", "a2", "b1", "a3", "c1", "b2"}},
+		{policy: "", order: []string{"a1", "a2", "b1", "a3", "c1", "b2"}},
+		{policy: SchedulePriority, order: []string{"b1", "a3", "a1", "a2", "b2", "c1"}},
+		{policy: ScheduleFair, order: []string{"a1", "b1", "c1", "a2", "b2", "a3"}},
+		{policy: SchedulePriorityFair, order: []string{"b1", "a3", "b2", "a1", "a2", "c1"}},
+	}
+	for _, c := range cases {
+		s := newScheduler(c.policy)
+		if order := waiterIDs(s.order(queue)); !reflect.DeepEqual(order, c.order) {
+			t.Errorf("policy %q: expected order %v, got: %v", c.policy, c.order, order)
+		}
+
+		// admitting one by one follows the predicted order
+		remaining := append([]*waiter(nil), queue...)
+		admitted := make([]*waiter, 0, len(queue))
+		for len(remaining) > 0 {
+			i := s.next(remaining)
+			w := remaining[i]
+			remaining = append(remaining[:i], remaining[i+1:]...)
+			s.admitted(w, remaining)
+			admitted = append(admitted, w)
+		}
+		if order := waiterIDs(admitted); !reflect.DeepEqual(order, c.order) {
+			t.Errorf("policy %q: expected admission order %v, got: %v", c.policy, c.order, order)
+		}
+	}
+}
+
+func TestSchedulerFairRotation(t *testing.T) {
+	s := newScheduler(ScheduleFair)
+	queue := []*waiter{
+		newTestWaiter("a1", "a", 0),
+		newTestWaiter("a2", "a", 0),
+		newTestWaiter("a3", "a", 0),
+		newTestWaiter("b1", "b", 0),
+		newTestWaiter("b2", "b", 0),
+	}
+	admit := func() string {
+		i := s.next(queue)
+		w := queue[i]
+		queue = append(queue[:i], queue[i+1:]...)
+		s.admitted(w, queue)
+		return w.id
+	}
+
+	admitted := []string{admit(), admit()}
+	// a user arriving later is served before users with backlog who were served already
+	queue = append(queue, newTestWaiter("c1", "c", 0))
+	for len(queue) > 0 {
+		admitted = append(admitted, admit())
+	}
+	if expected := []string{"a1", "b1", "c1", "a2", "b2", "a3"}; !reflect.DeepEqual(admitted, expected) {
+		t.Errorf("expected admission order %v, got: %v", expected, admitted)
+	}
+	if len(s.served) != 0 {
+		t.Errorf("expected users without waiters to be forgotten, got: %v", s.served)
+	}
+}
+
+func TestParseSchedulePolicy(t *testing.T) {
+	for _, name := range []string{"fifo", "priority", "fair", "priority-fair"} {
+		if policy, err := ParseSchedulePolicy(name); err != nil || string(policy) != name {
+			t.Errorf("expected policy %s, got: %s, err: %v", name, policy, err)
+		}
+	}
+	if _, err := ParseSchedulePolicy("random"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
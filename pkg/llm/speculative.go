@@ -0,0 +1,151 @@
+package llm
+
+import (
+	"expvar"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// defaultDraftTokens is the max number of tokens drafted at a time
+const defaultDraftTokens = 4
+
+// speculativeMetrics is published as expvar speculative, keyed by model name
+var speculativeMetrics = expvar.NewMap("speculative")
+
+// draftMetrics is metrics of tokens drafted for a model
+type draftMetrics struct {
+	// drafted is the number of tokens proposed by draft model
+	drafted expvar.Int
+	// accepted is the number of drafted tokens kept by the model
+	accepted expvar.Int
+}
+
+func newDraftMetrics(name string) *draftMetrics {
+	m := &draftMetrics{}
+	metrics := &expvar.Map{}
+	metrics.Set("drafted", &m.drafted)
+	metrics.Set("accepted", &m.accepted)
+	speculativeMetrics.Set(name, metrics)
+	return m
+}
+
+// speculator drafts tokens with a context of a smaller model, which follows tokens evaluated by the context of
+// the model
+type speculator struct {
+	draft    model.Model
+	draftNum int
+	metrics  *draftMetrics
+}
+
+func newSpeculator(draft model.Model, draftNum int, metrics *draftMetrics) *speculator {
+	if draftNum <= 0 {
+		draftNum = defaultDraftTokens
+	}
+	return &speculator{draft: draft, draftNum: draftNum, metrics: metrics}
+}
+
+// propose returns at most num tokens greedily drafted after evaluated tokens followed by last
+func (s *speculator) propose(evaluated []binding.Token, last binding.Token, num int, sampler *model.Sampler) []binding.Token {
+	if num <= 0 {
+		return nil
+	}
+	// tokens evaluated by draft context which are shared with the model are reused
+	tokens := append(evaluated[:len(evaluated):len(evaluated)], last)
+	matchNum := commonPrefix(s.draft.Tokens(), tokens)
+	s.draft.Rewind(matchNum)
+	tokens = tokens[matchNum:]
+
+	drafts := make([]binding.Token, 0, num)
+	for {
+		if err := s.draft.Eval(tokens); err != nil {
+			klog.Warningf("failed to draft tokens, err: %v", err)
+			return drafts
+		}
+		token, err := sampler.Sample()
+		if err != nil {
+			klog.Warningf("failed to draft tokens, err: %v", err)
+			return drafts
+		}
+		drafts = append(drafts, token)
+		if len(drafts) == num || token == binding.TokenEos() {
+			return drafts
+		}
+		tokens = []binding.Token{token}
+	}
+}
+
+// sampledToken is a token sampled by generator, with logits it is sampled from
+type sampledToken struct {
+	token  binding.Token
+	logits []float32
+}
+
+// generateSpeculative returns a generator like generate, which evaluates the pending token together with tokens
+// drafted after it in one batch. Tokens are sampled from logits of the batch one by one, drafted tokens are
+// kept until one differs from the sampled token. Every token is sampled from logits of the model, so generated
+// tokens follow the same distribution as without draft.
+func (l *llm) generateSpeculative(tokens []binding.Token, sampler, draftSampler *model.Sampler, keepNum int, c *choice) func() (binding.Token, []float32, error) {
+	s := l.speculator
+	var queue []sampledToken
+
+	verify := func() error {
+		if keepNum >= 0 && len(l.Tokens())+len(tokens) > l.ContextSize() {
+			if err := l.Shift(keepNum); err != nil {
+				return err
+			}
+		}
+		// logits of the last pending token are needed to verify the first draft, so it is evaluated with drafts
+		if len(tokens) > 1 {
+			if err := l.Eval(tokens[:len(tokens)-1]); err != nil {
+				return err
+			}
+			tokens = tokens[len(tokens)-1:]
+		}
+
+		draftNum := s.draftNum
+		if room := l.ContextSize() - len(l.Tokens()) - len(tokens); room < draftNum {
+			draftNum = room
+		}
+		drafts := s.propose(l.Tokens(), tokens[0], draftNum, draftSampler)
+		if err := l.Eval(append(tokens[:len(tokens):len(tokens)], drafts...)); err != nil {
+			return err
+		}
+
+		acceptedNum := 0
+		for i := 0; i <= len(drafts); i++ {
+			token, err := sampler.SampleBefore(len(drafts) - i)
+			if err != nil {
+				return err
+			}
+			queue = append(queue, sampledToken{token: token, logits: append([]float32(nil), sampler.Logits()...)})
+			if i == len(drafts) || token != drafts[i] {
+				break
+			}
+			acceptedNum++
+		}
+		// kv cache of rejected drafts is overwritten by later tokens
+		l.Rewind(len(l.Tokens()) - len(drafts) + acceptedNum)
+		tokens = []binding.Token{queue[len(queue)-1].token}
+
+		c.draftedNum += len(drafts)
+		c.acceptedNum += acceptedNum
+		s.metrics.drafted.Add(int64(len(drafts)))
+		s.metrics.accepted.Add(int64(acceptedNum))
+		return nil
+	}
+
+	next := func() (binding.Token, []float32, error) {
+		if len(queue) == 0 {
+			if err := verify(); err != nil {
+				return 0, nil, err
+			}
+		}
+		sampled := queue[0]
+		queue = queue[1:]
+		return sampled.token, sampled.logits, nil
+	}
+	return next
+}
@@ -0,0 +1,175 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// generatedToolCall is the format of tool calls generated by model, a json array of generatedToolCall is expected
+type generatedToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolCallsEnabled returns if generated text should be parsed as tool calls
+func toolCallsEnabled(p *params) bool {
+	return len(p.tools) > 0 && p.toolChoice.Type != ToolChoiceNone
+}
+
+// toolCallsForced returns if model must generate tool calls
+func toolCallsForced(p *params) bool {
+	return len(p.tools) > 0 && (p.toolChoice.Type == ToolChoiceRequired || p.toolChoice.Type == ToolChoiceFunction)
+}
+
+// applyToolChoice restricts generation to tool calls when tool choice forces them
+func applyToolChoice(p *params) error {
+	if !toolCallsForced(p) {
+		return nil
+	}
+	if p.grammar != nil {
+		return fmt.Errorf("grammar can not be used with tool choice: %s", p.toolChoice.Type)
+	}
+	grammar, err := toolCallsGrammar(p.tools, p.toolChoice)
+	if err != nil {
+		return err
+	}
+	p.grammar = grammar
+	return nil
+}
+
+// toolCallsGrammar returns grammar which only accepts calls of tools allowed by tool choice
+func toolCallsGrammar(tools []Tool, toolChoice ToolChoice) (*model.Grammar, error) {
+	calls := make([]any, 0, len(tools))
+	for _, tool := range tools {
+		if toolChoice.Type == ToolChoiceFunction && tool.Function.Name != toolChoice.Function {
+			continue
+		}
+		parameters := json.RawMessage(model.JSONObjectSchema)
+		if len(tool.Function.Parameters) > 0 {
+			parameters = tool.Function.Parameters
+		}
+		calls = append(calls, map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"name":      map[string]any{"const": tool.Function.Name},
+				"arguments": parameters,
+			},
+			"required": []string{"name", "arguments"},
+		})
+	}
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("tool choice function not found: %s", toolChoice.Function)
+	}
+
+	schema, err := json.Marshal(map[string]any{
+		"type":     "array",
+		"minItems": 1,
+		"items":    map[string]any{"anyOf": calls},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := model.JSONSchemaGrammar(schema)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("tool calls grammar: %s", text)
+	return model.ParseGrammar(text)
+}
+
+// isToolCallsPrefix returns if text starts like generated tool calls, ok is false when undecided yet
+func isToolCallsPrefix(text string) (isToolCalls bool, ok bool) {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return false, false
+	}
+	return trimmed[0] == '[' || trimmed[0] == '{', true
+}
+
+// parseToolCalls parses generated text into tool calls of known tools
+func parseToolCalls(text string, tools []Tool) ([]ToolCall, bool) {
+	text = strings.TrimSpace(text)
+	generated := make([]generatedToolCall, 0)
+	if strings.HasPrefix(text, "{") {
+		call := generatedToolCall{}
+		if err := json.Unmarshal([]byte(text), &call); err != nil {
+			return nil, false
+		}
+		generated = append(generated, call)
+	} else if err := json.Unmarshal([]byte(text), &generated); err != nil {
+		return nil, false
+	}
+
+	known := map[string]bool{}
+	for _, tool := range tools {
+		known[tool.Function.Name] = true
+	}
+
+	toolCalls := make([]ToolCall, 0, len(generated))
+	for _, call := range generated {
+		if !known[call.Name] {
+			klog.V(3).Infof("model called an unknown tool: %s", call.Name)
+			return nil, false
+		}
+		arguments := string(call.Arguments)
+		if arguments == "" {
+			arguments = "{}"
+		}
+		toolCalls = append(toolCalls, ToolCall{
+			ID:       "call_" + string(uuid.NewUUID()),
+			Type:     ToolChoiceFunction,
+			Function: FunctionCall{Name: call.Name, Arguments: arguments},
+		})
+	}
+	return toolCalls, len(toolCalls) > 0
+}
+
+// renderToolCalls renders tool calls of assistant message in the format model generates them
+func renderToolCalls(toolCalls []ToolCall) (string, error) {
+	generated := make([]generatedToolCall, 0, len(toolCalls))
+	for _, call := range toolCalls {
+		arguments := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(arguments) {
+			arguments = json.RawMessage("{}")
+		}
+		generated = append(generated, generatedToolCall{Name: call.Function.Name, Arguments: arguments})
+	}
+	data, err := json.Marshal(generated)
+	return string(data), err
+}
+
+// toolCallsBuffer holds back streamed output of a choice, until it is known whether the output is tool calls
+type toolCallsBuffer struct {
+	forced      bool
+	decided     bool
+	isToolCalls bool
+	text        strings.Builder
+}
+
+// write appends out to buffer, ready is true when pending text should be sent, either the output is known
+// to be a message or the choice is finished
+func (b *toolCallsBuffer) write(out string, finished bool) (text string, isToolCalls bool, ready bool) {
+	if b.decided && !b.isToolCalls {
+		return out, false, true
+	}
+
+	b.text.WriteString(out)
+
+	if !b.decided {
+		if b.forced {
+			b.decided, b.isToolCalls = true, true
+		} else if isToolCalls, ok := isToolCallsPrefix(b.text.String()); ok {
+			b.decided, b.isToolCalls = true, isToolCalls
+		}
+	}
+
+	ready = finished || (b.decided && !b.isToolCalls)
+	return b.text.String(), b.isToolCalls, ready
+}
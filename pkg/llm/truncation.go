@@ -0,0 +1,388 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// TruncationStrategy decides which messages are removed when chat history leaves no room for completion in
+// context. System messages and the last message are always kept.
+type TruncationStrategy string
+
+const (
+	// TruncationNone fails the request
+	TruncationNone TruncationStrategy = "none"
+	// TruncationDropOldest removes the oldest messages
+	TruncationDropOldest TruncationStrategy = "drop_oldest"
+	// TruncationLastMessages keeps only the last n user and assistant messages, with tool results of kept tool calls,
+	// then removes the oldest of them if needed
+	TruncationLastMessages TruncationStrategy = "last_messages"
+	// TruncationMiddleOut removes messages from the middle, so that the start and the end of chat are kept
+	TruncationMiddleOut TruncationStrategy = "middle_out"
+	// TruncationSummarize replaces the oldest messages with their summary written by the model
+	TruncationSummarize TruncationStrategy = "summarize"
+)
+
+const (
+	defaultLastMessages     = 10
+	defaultSummaryMaxTokens = 256
+	summaryInstruction      = "Summarize the following conversation in a few sentences. Keep names, facts, decisions and open questions."
+	summaryPrefix           = "Summary of the earlier conversation: "
+	maxCachedSummaries      = 256
+)
+
+// ParseTruncationStrategy returns strategy by name, empty name is none
+func ParseTruncationStrategy(name string) (TruncationStrategy, error) {
+	switch strategy := TruncationStrategy(name); strategy {
+	case "":
+		return TruncationNone, nil
+	case TruncationNone, TruncationDropOldest, TruncationLastMessages, TruncationMiddleOut, TruncationSummarize:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown truncation strategy: %s", name)
+}
+
+// summaryCache keeps summaries of removed messages, so that following requests of a chat reuse the summary and
+// the prompt prefix stays the same. It is shared by contexts of the same model.
+type summaryCache struct {
+	summaries map[string]string
+	keys      []string
+	locker    sync.Mutex
+}
+
+func newSummaryCache() *summaryCache {
+	return &summaryCache{summaries: map[string]string{}}
+}
+
+func (c *summaryCache) get(key string) (string, bool) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	summary, ok := c.summaries[key]
+	return summary, ok
+}
+
+func (c *summaryCache) put(key, summary string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if _, ok := c.summaries[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.summaries[key] = summary
+	for len(c.keys) > maxCachedSummaries {
+		delete(c.summaries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+}
+
+// fitChatPrompt tokenizes chat prompt of input. When the prompt leaves less than maxTokens of context for
+// completion, messages are removed by truncation strategy until it fits.
+func (l *llm) fitChatPrompt(ctx context.Context, input []ChatCompletionMessage, maxTokens int, p *params) ([]binding.Token, error) {
+	promptTokens, err := l.tokenizeChatPrompt(input, p.tools)
+	if err != nil {
+		return nil, err
+	}
+
+	contextSize := *l.modelConfig.Context
+	if p.truncation == "" || p.truncation == TruncationNone {
+		if len(promptTokens) >= contextSize {
+			return nil, fmt.Errorf("tokens exceeds max context size: %d", contextSize)
+		}
+		return promptTokens, nil
+	}
+
+	budget := contextSize - maxTokens
+	if budget < 1 || p.contextShift {
+		// completion does not need to fit context when context is shifted
+		budget = contextSize - 1
+	}
+	if len(promptTokens) <= budget {
+		return promptTokens, nil
+	}
+
+	order, mandatory := l.truncationOrder(input, p)
+	if p.truncation == TruncationSummarize {
+		if tokens, ok := l.summarizeHistory(ctx, input, order, budget, p); ok {
+			return tokens, nil
+		}
+	}
+
+	removedNum, tokens, err := l.searchTruncation(input, order, mandatory, budget, p)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(3).Infof("chat history truncated by %s, removed message num: %d, prompt token num: %d", p.truncation, removedNum, len(tokens))
+	return tokens, nil
+}
+
+// truncationOrder returns indexes of removable messages in the order they are removed, the first mandatory of
+// them are removed even if the prompt fits without removing them
+func (l *llm) truncationOrder(input []ChatCompletionMessage, p *params) ([]int, int) {
+	removable := make([]int, 0, len(input))
+	for i := 0; i < len(input)-1; i++ {
+		if input[i].Role != l.role(SystemRole) {
+			removable = append(removable, i)
+		}
+	}
+
+	switch p.truncation {
+	case TruncationMiddleOut:
+		positions := make([]int, len(removable))
+		for i := range positions {
+			positions[i] = i
+		}
+		middle := float64(len(removable)-1) / 2
+		sort.SliceStable(positions, func(i, j int) bool {
+			return math.Abs(float64(positions[i])-middle) < math.Abs(float64(positions[j])-middle)
+		})
+		order := make([]int, len(positions))
+		for i, position := range positions {
+			order[i] = removable[position]
+		}
+		return order, 0
+	case TruncationLastMessages:
+		lastMessages := p.lastMessages
+		if lastMessages <= 0 {
+			lastMessages = defaultLastMessages
+		}
+		return removable, l.lastMessagesStart(input, removable, lastMessages)
+	}
+	return removable, 0
+}
+
+// lastMessagesStart returns the number of removable messages before the last n user and assistant messages. Tool
+// messages are not counted, tool results before the kept messages are removed with their calls, and those after
+// them are kept with their calls.
+func (l *llm) lastMessagesStart(input []ChatCompletionMessage, removable []int, n int) int {
+	isTurn := func(message ChatCompletionMessage) bool {
+		return message.Role == l.role(UserRole) || message.Role == l.role(AssistantRole)
+	}
+	// the last message is not removable, so it is one of the kept messages
+	if isTurn(input[len(input)-1]) {
+		n--
+	}
+	start := len(removable)
+	for ; start > 0 && n > 0; start-- {
+		if isTurn(input[removable[start-1]]) {
+			n--
+		}
+	}
+	return start
+}
+
+// searchTruncation removes the fewest messages in order so that prompt fits budget, and returns the number of
+// removed messages and the prompt tokens
+func (l *llm) searchTruncation(input []ChatCompletionMessage, order []int, mandatory, budget int, p *params) (int, []binding.Token, error) {
+	tokenize := func(removedNum int) ([]binding.Token, error) {
+		return l.tokenizeChatPrompt(removeMessages(input, order[:removedNum], l.role(ToolRole)), p.tools)
+	}
+
+	tokens, err := tokenize(len(order))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(tokens) > budget {
+		return 0, nil, fmt.Errorf("tokens exceeds max context size: %d, even if chat history is truncated", *l.modelConfig.Context)
+	}
+
+	// fewer messages never make the prompt longer, tokens is always the prompt of high removed messages
+	low, high := mandatory, len(order)
+	for low < high {
+		mid := (low + high) / 2
+		midTokens, err := tokenize(mid)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(midTokens) <= budget {
+			high, tokens = mid, midTokens
+		} else {
+			low = mid + 1
+		}
+	}
+	return low, tokens, nil
+}
+
+// summarizeHistory replaces the oldest messages with their summary, a cached summary is preferred so that the
+// prompt prefix is stable across requests of a chat. It returns false when the prompt can not fit with a summary.
+func (l *llm) summarizeHistory(ctx context.Context, input []ChatCompletionMessage, order []int, budget int, p *params) ([]binding.Token, bool) {
+	if len(order) == 0 {
+		return nil, false
+	}
+	keys := summaryKeys(input, order)
+
+	for removedNum := len(order); removedNum > 0; removedNum-- {
+		summary, ok := l.summaries.get(keys[removedNum-1])
+		if !ok {
+			continue
+		}
+		tokens, err := l.tokenizeChatPrompt(l.withSummary(input, order[:removedNum], summary), p.tools)
+		if err == nil && len(tokens) <= budget {
+			klog.V(3).Infof("chat history summary found, removed message num: %d, prompt token num: %d", removedNum, len(tokens))
+			return tokens, true
+		}
+		break
+	}
+
+	// more messages than needed are summarized, so that the summary is reused by following requests
+	summaryMaxTokens := l.summaryMaxTokens()
+	removedNum, _, err := l.searchTruncation(input, order, 0, (budget-summaryMaxTokens)/2, p)
+	if err != nil {
+		if removedNum, _, err = l.searchTruncation(input, order, 0, budget-summaryMaxTokens, p); err != nil {
+			removedNum = len(order)
+		}
+	}
+	if removedNum == 0 {
+		return nil, false
+	}
+
+	removed := make([]ChatCompletionMessage, 0, removedNum)
+	for _, i := range order[:removedNum] {
+		removed = append(removed, input[i])
+	}
+	summary, err := l.summarize(ctx, removed, summaryMaxTokens)
+	if err != nil {
+		klog.Errorf("failed to summarize chat history, err: %v", err)
+		return nil, false
+	}
+	l.summaries.put(keys[removedNum-1], summary)
+
+	tokens, err := l.tokenizeChatPrompt(l.withSummary(input, order[:removedNum], summary), p.tools)
+	if err != nil || len(tokens) > budget {
+		return nil, false
+	}
+	klog.V(3).Infof("chat history summarized, removed message num: %d, prompt token num: %d", removedNum, len(tokens))
+	return tokens, true
+}
+
+// summarize returns summary of messages written by the model, the oldest part of a transcript which does not
+// fit context is cut
+func (l *llm) summarize(ctx context.Context, messages []ChatCompletionMessage, maxTokens int) (string, error) {
+	builder := strings.Builder{}
+	for _, message := range messages {
+		content := message.Content
+		if len(message.ToolCalls) > 0 {
+			calls, err := renderToolCalls(message.ToolCalls)
+			if err != nil {
+				return "", err
+			}
+			content = calls
+		}
+		builder.WriteString(fmt.Sprintf("%s: %s\n", message.Role, content))
+	}
+	transcript := builder.String()
+
+	limit := *l.modelConfig.Context - maxTokens
+	var promptTokens []binding.Token
+	for {
+		instruction := []ChatCompletionMessage{
+			{Role: l.role(SystemRole), Content: summaryInstruction},
+			{Role: l.role(UserRole), Content: transcript},
+		}
+		tokens, err := l.tokenizeChatPrompt(instruction, nil)
+		if err != nil {
+			return "", err
+		}
+		if len(tokens) <= limit {
+			promptTokens = tokens
+			break
+		}
+
+		transcriptTokens, err := l.Tokenize(transcript, false)
+		if err != nil {
+			return "", err
+		}
+		excess := len(tokens) - limit
+		if excess >= len(transcriptTokens) {
+			return "", fmt.Errorf("summary instruction exceeds max context size: %d", *l.modelConfig.Context)
+		}
+		transcript = l.Detokenize(transcriptTokens[excess:])
+	}
+
+	// the summary is generated on context, which drops the session it holds
+	if err := l.storeHeldSession(); err != nil {
+		return "", err
+	}
+	matchNum := l.restorePrefix(promptTokens)
+	p := newParams(WithSampleOptions(model.WithTemp(-1)))
+	c, err := l.generateChoice(ctx, 0, promptTokens[matchNum:], len(promptTokens), maxTokens, l.modelConfig.Stops, nil, p)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(c.text), nil
+}
+
+// withSummary returns input without removed messages, the summary of them follows the leading system messages
+func (l *llm) withSummary(input []ChatCompletionMessage, removed []int, summary string) []ChatCompletionMessage {
+	kept := removeMessages(input, removed, l.role(ToolRole))
+	at := 0
+	for at < len(kept) && kept[at].Role == l.role(SystemRole) {
+		at++
+	}
+	messages := make([]ChatCompletionMessage, 0, len(kept)+1)
+	messages = append(messages, kept[:at]...)
+	messages = append(messages, ChatCompletionMessage{Role: l.role(SystemRole), Content: summaryPrefix + summary})
+	return append(messages, kept[at:]...)
+}
+
+func (l *llm) summaryMaxTokens() int {
+	if l.modelConfig.Truncation.SummaryMaxTokens > 0 {
+		return l.modelConfig.Truncation.SummaryMaxTokens
+	}
+	return defaultSummaryMaxTokens
+}
+
+// role returns role of model for role of api
+func (l *llm) role(role string) string {
+	if mapped, ok := l.modelConfig.Roles[role]; ok {
+		return mapped
+	}
+	return role
+}
+
+// removeMessages returns input without removed messages, tool results whose calls are removed are removed too
+func removeMessages(input []ChatCompletionMessage, removed []int, toolRole string) []ChatCompletionMessage {
+	skip := make(map[int]bool, len(removed))
+	for _, i := range removed {
+		skip[i] = true
+	}
+	messages := make([]ChatCompletionMessage, 0, len(input))
+	callRemoved := false
+	for i, message := range input {
+		if message.Role == toolRole {
+			if skip[i] || (callRemoved && i < len(input)-1) {
+				continue
+			}
+		} else {
+			callRemoved = skip[i] && len(message.ToolCalls) > 0
+			if skip[i] {
+				continue
+			}
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// summaryKeys returns keys of summaries of the first i+1 messages in order
+func summaryKeys(input []ChatCompletionMessage, order []int) []string {
+	keys := make([]string, len(order))
+	h := sha256.New()
+	encoder := json.NewEncoder(h)
+	for i, index := range order {
+		encoder.Encode(input[index])
+		keys[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return keys
+}
@@ -0,0 +1,191 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
+)
+
+// fakeModel counts a token per word of text, other operations are not supported
+type fakeModel struct {
+	model.Model
+	words  []string
+	ids    map[string]binding.Token
+	tokens []binding.Token
+}
+
+func (m *fakeModel) Tokenize(text string, addBos bool) ([]binding.Token, error) {
+	if m.ids == nil {
+		m.ids = map[string]binding.Token{}
+	}
+	tokens := make([]binding.Token, 0)
+	for _, word := range strings.Fields(text) {
+		id, ok := m.ids[word]
+		if !ok {
+			id = binding.Token(len(m.words))
+			m.ids[word] = id
+			m.words = append(m.words, word)
+		}
+		tokens = append(tokens, id)
+	}
+	return tokens, nil
+}
+
+func (m *fakeModel) SaveState() (*model.State, error) {
+	return &model.State{Tokens: m.tokens, Data: []byte("state")}, nil
+}
+
+// newTestLLM returns a llm whose chat prompt is a line of role and content per message
+func newTestLLM(contextSize int) (*llm, *fakeModel) {
+	m := &fakeModel{}
+	chat := template.Must(template.New("chat").Funcs(templateFuncs).Parse("{{range .Input}}{{.Role}}: {{.Content}}\n{{end}}"))
+	return &llm{
+		Model:       m,
+		modelConfig: &config.ModelConfig{Context: &contextSize},
+		templates:   map[string]*template.Template{"chat": chat},
+		summaries:   newSummaryCache(),
+	}, m
+}
+
+// keptContents returns content of messages in prompt tokens
+func keptContents(m *fakeModel, tokens []binding.Token) []string {
+	contents := make([]string, 0)
+	for i := 1; i < len(tokens); i += 2 {
+		contents = append(contents, m.words[tokens[i]])
+	}
+	return contents
+}
+
+func message(role, content string) ChatCompletionMessage {
+	return ChatCompletionMessage{Role: role, Content: content}
+}
+
+func TestFitChatPrompt(t *testing.T) {
+	// every message is 2 tokens
+	chat := []ChatCompletionMessage{
+		message(SystemRole, "s"),
+		message(UserRole, "u1"),
+		message(AssistantRole, "a1"),
+		message(UserRole, "u2"),
+		message(AssistantRole, "a2"),
+		message(UserRole, "u3"),
+	}
+	toolCall := ChatCompletionMessage{Role: AssistantRole, Content: "call", ToolCalls: []ToolCall{{ID: "1", Type: "function"}}}
+	toolChat := []ChatCompletionMessage{
+		message(SystemRole, "s"),
+		message(UserRole, "u1"),
+		toolCall,
+		message(ToolRole, "t1"),
+		message(ToolRole, "t2"),
+		message(AssistantRole, "a2"),
+		message(UserRole, "u2"),
+	}
+
+	cases := []struct {
+		name        string
+		input       []ChatCompletionMessage
+		contextSize int
+		maxTokens   int
+		opts        []Option
+		kept        []string
+		err         bool
+	}{
+		{name: "none fits", input: chat, contextSize: 13, maxTokens: 100, kept: []string{"s", "u1", "a1", "u2", "a2", "u3"}},
+		{name: "none exceeds", input: chat, contextSize: 12, maxTokens: 1, err: true},
+		{name: "fits without truncation", input: chat, contextSize: 20, maxTokens: 8, opts: []Option{WithTruncation(TruncationDropOldest, 0)}, kept: []string{"s", "u1", "a1", "u2", "a2", "u3"}},
+		{name: "drop oldest", input: chat, contextSize: 20, maxTokens: 10, opts: []Option{WithTruncation(TruncationDropOldest, 0)}, kept: []string{"s", "a1", "u2", "a2", "u3"}},
+		// the fewest messages are removed
+		{name: "drop oldest fewest", input: chat, contextSize: 20, maxTokens: 12, opts: []Option{WithTruncation(TruncationDropOldest, 0)}, kept: []string{"s", "u2", "a2", "u3"}},
+		{name: "drop oldest keeps system and last", input: chat, contextSize: 20, maxTokens: 16, opts: []Option{WithTruncation(TruncationDropOldest, 0)}, kept: []string{"s", "u3"}},
+		{name: "drop oldest exceeds", input: chat, contextSize: 20, maxTokens: 17, opts: []Option{WithTruncation(TruncationDropOldest, 0)}, err: true},
+		// completion does not need to fit context when context is shifted
+		{name: "context shift", input: chat, contextSize: 12, maxTokens: 100, opts: []Option{WithTruncation(TruncationDropOldest, 0), WithContextShift(-1)}, kept: []string{"s", "a1", "u2", "a2", "u3"}},
+		{name: "middle out", input: chat, contextSize: 20, maxTokens: 12, opts: []Option{WithTruncation(TruncationMiddleOut, 0)}, kept: []string{"s", "u1", "a2", "u3"}},
+		// last messages are kept even if fewer messages are enough, once history exceeds context
+		{name: "last messages", input: chat, contextSize: 20, maxTokens: 10, opts: []Option{WithTruncation(TruncationLastMessages, 2)}, kept: []string{"s", "a2", "u3"}},
+		{name: "last messages fit", input: chat, contextSize: 100, maxTokens: 10, opts: []Option{WithTruncation(TruncationLastMessages, 2)}, kept: []string{"s", "u1", "a1", "u2", "a2", "u3"}},
+		{name: "last messages removes more", input: chat, contextSize: 20, maxTokens: 14, opts: []Option{WithTruncation(TruncationLastMessages, 3)}, kept: []string{"s", "a2", "u3"}},
+		{name: "last messages keeps tool results of kept call", input: toolChat, contextSize: 20, maxTokens: 8, opts: []Option{WithTruncation(TruncationLastMessages, 3)}, kept: []string{"s", "call", "t1", "t2", "a2", "u2"}},
+		{name: "last messages removes tool results of removed call", input: toolChat, contextSize: 20, maxTokens: 8, opts: []Option{WithTruncation(TruncationLastMessages, 2)}, kept: []string{"s", "a2", "u2"}},
+		{name: "drop oldest removes tool results with call", input: toolChat, contextSize: 20, maxTokens: 10, opts: []Option{WithTruncation(TruncationDropOldest, 0)}, kept: []string{"s", "a2", "u2"}},
+	}
+	for _, c := range cases {
+		l, m := newTestLLM(c.contextSize)
+		tokens, err := l.fitChatPrompt(context.Background(), c.input, c.maxTokens, newParams(c.opts...))
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to fit chat prompt, err: %v", c.name, err)
+			continue
+		}
+		if kept := keptContents(m, tokens); !reflect.DeepEqual(kept, c.kept) {
+			t.Errorf("%s: expected kept messages %v, got: %v", c.name, c.kept, kept)
+		}
+		if len(tokens) != 2*len(c.kept) {
+			t.Errorf("%s: expected %d tokens, got: %d", c.name, 2*len(c.kept), len(tokens))
+		}
+	}
+}
+
+func TestSummaryCache(t *testing.T) {
+	c := newSummaryCache()
+	for i := 0; i < maxCachedSummaries+2; i++ {
+		c.put(fmt.Sprint(i), fmt.Sprintf("summary %d", i))
+	}
+	// a summary put again is not counted twice
+	c.put(fmt.Sprint(maxCachedSummaries+1), "updated")
+
+	if _, ok := c.get("0"); ok {
+		t.Error("expected the oldest summary to be evicted")
+	}
+	if _, ok := c.get("1"); ok {
+		t.Error("expected the second oldest summary to be evicted")
+	}
+	if summary, ok := c.get("2"); !ok || summary != "summary 2" {
+		t.Errorf("expected summary 2 to be kept, got: %q", summary)
+	}
+	if summary, ok := c.get(fmt.Sprint(maxCachedSummaries + 1)); !ok || summary != "updated" {
+		t.Errorf("expected updated summary, got: %q", summary)
+	}
+	if len(c.keys) != maxCachedSummaries || len(c.summaries) != maxCachedSummaries {
+		t.Errorf("expected %d summaries, got: %d keys, %d summaries", maxCachedSummaries, len(c.keys), len(c.summaries))
+	}
+}
+
+func TestStoreHeldSession(t *testing.T) {
+	l, m := newTestLLM(100)
+	l.modelConfig.Session.Enable = true
+	l.sessions = session.NewMemoryStore(1<<20, nil)
+	m.tokens = []binding.Token{1, 2, 3}
+
+	if err := l.storeHeldSession(); err != nil {
+		t.Fatalf("failed to store held session, err: %v", err)
+	}
+	if infos, _ := l.sessions.List(); len(infos) != 0 {
+		t.Errorf("expected nothing stored without held session, got: %v", infos)
+	}
+
+	l.session = "a"
+	if err := l.storeHeldSession(); err != nil {
+		t.Fatalf("failed to store held session, err: %v", err)
+	}
+	state, err := l.sessions.Get("a")
+	if err != nil {
+		t.Fatalf("expected held session to be stored, err: %v", err)
+	}
+	if !reflect.DeepEqual(state.Tokens, m.tokens) {
+		t.Errorf("expected state of context, got: %v", state.Tokens)
+	}
+}
@@ -1,5 +1,7 @@
 package llm
 
+import "encoding/json"
+
 const (
 	// SystemRole system
 	SystemRole = "system"
@@ -7,6 +9,19 @@ const (
 	UserRole = "user"
 	// AssistantRole assistant
 	AssistantRole = "assistant"
+	// ToolRole tool
+	ToolRole = "tool"
+)
+
+const (
+	// ToolChoiceNone disables tool calls
+	ToolChoiceNone = "none"
+	// ToolChoiceAuto lets model decide between message and tool calls
+	ToolChoiceAuto = "auto"
+	// ToolChoiceRequired forces model to call one or more tools
+	ToolChoiceRequired = "required"
+	// ToolChoiceFunction forces model to call the function of ToolChoice
+	ToolChoiceFunction = "function"
 )
 
 // EmbeddingUsage is token usage of embedding
@@ -40,10 +55,12 @@ type CompletionLogprobs struct {
 
 // CompletionChoice is completion choice
 type CompletionChoice struct {
-	Text         string             `json:"text"`
-	Index        int                `json:"index"`
-	Logprobs     CompletionLogprobs `json:"logprobs"`
-	FinishReason string             `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason string              `json:"finish_reason"`
+	// Incomplete is true when text is cut by length before it completes grammar or response format
+	Incomplete bool `json:"incomplete,omitempty"`
 }
 
 // CompletionUsage is token usage
@@ -51,6 +68,24 @@ type CompletionUsage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// PromptTokensDetails is breakdown of prompt tokens
+	PromptTokensDetails PromptTokensDetails `json:"prompt_tokens_details"`
+	// CompletionTokensDetails is breakdown of completion tokens
+	CompletionTokensDetails CompletionTokensDetails `json:"completion_tokens_details"`
+}
+
+// CompletionTokensDetails is breakdown of completion tokens
+type CompletionTokensDetails struct {
+	// AcceptedPredictionTokens is the number of tokens drafted by draft model, which are sampled by the model too
+	AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
+	// RejectedPredictionTokens is the number of tokens drafted by draft model, which are discarded
+	RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
+}
+
+// PromptTokensDetails is breakdown of prompt tokens
+type PromptTokensDetails struct {
+	// CachedTokens is the number of prompt tokens reused from earlier requests, rather than evaluated
+	CachedTokens int `json:"cached_tokens"`
 }
 
 // CompletionChunk is chunk for stream
@@ -74,16 +109,75 @@ type Completion struct {
 
 // ChatCompletionMessage is chat message
 type ChatCompletionMessage struct {
-	Role    string `json:"role" bind:"required"`
-	Content string `json:"content" bind:"required"`
-	User    string `json:"user"`
+	Role       string     `json:"role" bind:"required"`
+	Content    string     `json:"content" bind:"required"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	User       string     `json:"user"`
+}
+
+// FunctionDefinition describes a function model can call, parameters is a json schema
+type FunctionDefinition struct {
+	Name        string          `json:"name" bind:"required"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// Tool is a tool model can call
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// ToolChoice controls which tool is called, type is one of none, auto, required and function
+type ToolChoice struct {
+	Type     string
+	Function string
+}
+
+// FunctionCall is a function called by model, arguments is json encoded
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolCall is a tool called by model, index is only set in stream
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// ChatCompletionTopLogprob is log probability of an alternative token
+type ChatCompletionTopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float32 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// ChatCompletionTokenLogprob is log probability of a generated token
+type ChatCompletionTokenLogprob struct {
+	Token       string                     `json:"token"`
+	Logprob     float32                    `json:"logprob"`
+	Bytes       []int                      `json:"bytes"`
+	TopLogprobs []ChatCompletionTopLogprob `json:"top_logprobs"`
+}
+
+// ChatCompletionLogprobs is chat completion log probs for choice
+type ChatCompletionLogprobs struct {
+	Content []ChatCompletionTokenLogprob `json:"content"`
 }
 
 // ChatCompletionChoice is a choice of chat result
 type ChatCompletionChoice struct {
-	Index        int                   `json:"index"`
-	Message      ChatCompletionMessage `json:"message"`
-	FinishReason string                `json:"finish_reason"`
+	Index        int                     `json:"index"`
+	Message      ChatCompletionMessage   `json:"message"`
+	Logprobs     *ChatCompletionLogprobs `json:"logprobs"`
+	FinishReason string                  `json:"finish_reason"`
+	// Incomplete is true when content is cut by length before it completes grammar or response format
+	Incomplete bool `json:"incomplete,omitempty"`
 }
 
 // ChatCompletion is chat result
@@ -98,15 +192,20 @@ type ChatCompletion struct {
 
 // ChatCompletionChunkDelta used for stream
 type ChatCompletionChunkDelta struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 // ChatCompletionChunkChoice is a choice of chat result for stream
 type ChatCompletionChunkChoice struct {
 	Index        int                      `json:"index"`
 	Delta        ChatCompletionChunkDelta `json:"delta"`
+	Logprobs     *ChatCompletionLogprobs  `json:"logprobs"`
 	FinishReason string                   `json:"finish_reason"`
+	// Incomplete is true on the last chunk when content is cut by length before it completes grammar or
+	// response format
+	Incomplete bool `json:"incomplete,omitempty"`
 }
 
 // ChatCompletionChunk is chat result chunk for stream
@@ -2,25 +2,190 @@ package llm
 
 import (
 	"bytes"
+	"encoding/json"
+	"sort"
 	"strings"
 	"text/template"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
 )
 
-func matchAnyStop(output string, stops []string) (bool, string) {
+// indexAnyStop returns index of the first stop sequence in output, or -1 if there is none. Output before from is
+// known to contain no stop sequence, so only sequences ending after it are searched.
+func indexAnyStop(output string, stops []string, from int) int {
+	index := -1
 	for _, stop := range stops {
-		if strings.HasSuffix(output, stop) {
-			return true, stop
+		if stop == "" {
+			continue
+		}
+		start := from - len(stop) + 1
+		if start < 0 {
+			start = 0
+		}
+		if i := strings.Index(output[start:], stop); i >= 0 && (index < 0 || start+i < index) {
+			index = start + i
 		}
 	}
-	return false, ""
+	return index
+}
+
+// stopPrefixLen returns length of the longest suffix of output which is the beginning of a stop sequence
+func stopPrefixLen(output string, stops []string) int {
+	longest := 0
+	for _, stop := range stops {
+		for n := len(stop) - 1; n > longest; n-- {
+			if strings.HasSuffix(output, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// stopBuffer accumulates output of a choice, which is cut at the first stop sequence. Output which may be the
+// beginning of a stop sequence is held back until it is known not to be.
+type stopBuffer struct {
+	stops   []string
+	builder strings.Builder
+	// sentNum is the length of text passed out by next
+	sentNum int
+}
+
+// len returns length of output written so far
+func (b *stopBuffer) len() int {
+	return b.builder.Len()
+}
+
+// write appends out to output, and returns output cut at the first stop sequence, and whether it is found
+func (b *stopBuffer) write(out string) (string, bool) {
+	b.builder.WriteString(out)
+	text := b.builder.String()
+	if at := indexAnyStop(text, b.stops, len(text)-len(out)); at >= 0 {
+		return text[:at], true
+	}
+	return text, false
 }
 
-func render(promptTemplate *template.Template, input any) (string, error) {
+// next returns text returned by write which is not passed out yet, and false if there is none. Held back text is
+// passed out when final.
+func (b *stopBuffer) next(text string, final bool) (string, bool) {
+	sendable := len(text)
+	if !final {
+		sendable -= stopPrefixLen(text, b.stops)
+	}
+	if sendable <= b.sentNum && !final {
+		return "", false
+	}
+	delta := text[b.sentNum:sendable]
+	b.sentNum = sendable
+	return delta, true
+}
+
+// templateFuncs are functions available in prompt templates
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"toolCalls": renderToolCalls,
+}
+
+func render(promptTemplate *template.Template, input any, tools []Tool) (string, error) {
 	buff := &bytes.Buffer{}
-	err := promptTemplate.Execute(buff, map[string]any{"Input": input})
+	err := promptTemplate.Execute(buff, map[string]any{"Input": input, "Tools": tools})
 	if err != nil {
 		return "", err
 	}
 	renderedPrompt := buff.String()
 	return renderedPrompt, nil
 }
+
+// topLogprobs returns n tokens with highest logits, in descending order
+func topLogprobs(logits []float32, n int) []binding.Token {
+	if n > len(logits) {
+		n = len(logits)
+	}
+	top := make([]binding.Token, 0, n+1)
+	for i, logit := range logits {
+		if len(top) == n && (n == 0 || logit <= logits[top[n-1]]) {
+			continue
+		}
+		j := sort.Search(len(top), func(k int) bool {
+			return logits[top[k]] < logit
+		})
+		top = append(top, 0)
+		copy(top[j+1:], top[j:])
+		top[j] = binding.Token(i)
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+	return top
+}
+
+// bestChoices returns n choices with highest cumulative log probability, reindexed by rank
+func bestChoices(choices []*choice, n int) []*choice {
+	if len(choices) <= n {
+		return choices
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].logprob > choices[j].logprob
+	})
+	choices = choices[:n]
+	for i, c := range choices {
+		c.index = i
+	}
+	return choices
+}
+
+// completionLogprobs converts token log probabilities to completion logprobs, offset is added to text offsets
+func completionLogprobs(logprobs []tokenLogprob, offset int) *CompletionLogprobs {
+	result := &CompletionLogprobs{
+		TextOffset:    make([]int, 0, len(logprobs)),
+		TokenLogprobs: make([]float32, 0, len(logprobs)),
+		Tokens:        make([]string, 0, len(logprobs)),
+		TopLogprobs:   make([]map[string]float32, 0, len(logprobs)),
+	}
+	for _, logprob := range logprobs {
+		result.TextOffset = append(result.TextOffset, logprob.offset+offset)
+		result.TokenLogprobs = append(result.TokenLogprobs, logprob.logprob)
+		result.Tokens = append(result.Tokens, logprob.text)
+		top := map[string]float32{}
+		for _, t := range logprob.top {
+			top[t.text] = t.logprob
+		}
+		result.TopLogprobs = append(result.TopLogprobs, top)
+	}
+	return result
+}
+
+// chatCompletionLogprobs converts token log probabilities to chat completion logprobs
+func chatCompletionLogprobs(logprobs []tokenLogprob) *ChatCompletionLogprobs {
+	result := &ChatCompletionLogprobs{Content: make([]ChatCompletionTokenLogprob, 0, len(logprobs))}
+	for _, logprob := range logprobs {
+		content := ChatCompletionTokenLogprob{
+			Token:       logprob.text,
+			Logprob:     logprob.logprob,
+			Bytes:       textBytes(logprob.text),
+			TopLogprobs: make([]ChatCompletionTopLogprob, 0, len(logprob.top)),
+		}
+		for _, t := range logprob.top {
+			content.TopLogprobs = append(content.TopLogprobs, ChatCompletionTopLogprob{
+				Token:   t.text,
+				Logprob: t.logprob,
+				Bytes:   textBytes(t.text),
+			})
+		}
+		result.Content = append(result.Content, content)
+	}
+	return result
+}
+
+func textBytes(text string) []int {
+	result := make([]int, 0, len(text))
+	for _, b := range []byte(text) {
+		result = append(result, int(b))
+	}
+	return result
+}
@@ -0,0 +1,214 @@
+package llm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+)
+
+func TestIndexAnyStop(t *testing.T) {
+	cases := []struct {
+		output string
+		stops  []string
+		from   int
+		index  int
+	}{
+		{output: "hello world", stops: []string{"world"}, from: 0, index: 6},
+		{output: "hello world", stops: []string{"planet"}, from: 0, index: -1},
+		{output: "hello world", stops: nil, from: 0, index: -1},
+		{output: "hello world", stops: []string{""}, from: 0, index: -1},
+		// a stop ending in new output is found although it starts before from
+		{output: "hello ###", stops: []string{"###"}, from: 8, index: 6},
+		// a stop ending before from was found already
+		{output: "### hello", stops: []string{"###"}, from: 5, index: -1},
+		// the earliest of overlapping stops wins
+		{output: "xabcd", stops: []string{"bcd", "abc"}, from: 0, index: 1},
+		{output: "xabcd", stops: []string{"abcx", "bcd"}, from: 0, index: 2},
+	}
+	for _, c := range cases {
+		if index := indexAnyStop(c.output, c.stops, c.from); index != c.index {
+			t.Errorf("output %q, stops %q, from %d: expected index %d, got: %d", c.output, c.stops, c.from, c.index, index)
+		}
+	}
+}
+
+func TestStopPrefixLen(t *testing.T) {
+	cases := []struct {
+		output string
+		stops  []string
+		n      int
+	}{
+		{output: "hello", stops: []string{"###"}, n: 0},
+		{output: "hello #", stops: []string{"###"}, n: 1},
+		{output: "hello ##", stops: []string{"###"}, n: 2},
+		// a whole stop is not a prefix, it is found by indexAnyStop
+		{output: "hello ###", stops: []string{"###"}, n: 2},
+		{output: "hello ab", stops: []string{"b!", "abc"}, n: 2},
+		{output: "", stops: []string{"###"}, n: 0},
+	}
+	for _, c := range cases {
+		if n := stopPrefixLen(c.output, c.stops); n != c.n {
+			t.Errorf("output %q, stops %q: expected %d, got: %d", c.output, c.stops, c.n, n)
+		}
+	}
+}
+
+func TestStopBuffer(t *testing.T) {
+	cases := []struct {
+		name  string
+		stops []string
+		// outs is output of tokens, the last token is a stop token without output if stopToken is set
+		outs      []string
+		stopToken bool
+		deltas    []string
+		text      string
+		found     bool
+	}{
+		{
+			name:   "no stop",
+			stops:  []string{"###"},
+			outs:   []string{"Hello", " world"},
+			deltas: []string{"Hello", " world"},
+			text:   "Hello world",
+		},
+		{
+			name:   "stop split across tokens",
+			stops:  []string{"###"},
+			outs:   []string{"Hello", " #", "#", "#", "ignored"},
+			deltas: []string{"Hello", " ", ""},
+			text:   "Hello ",
+			found:  true,
+		},
+		{
+			name:   "stop within token",
+			stops:  []string{"###"},
+			outs:   []string{"Hello", " ### world"},
+			deltas: []string{"Hello", " "},
+			text:   "Hello ",
+			found:  true,
+		},
+		{
+			name:   "stop prefix which is not a stop is flushed",
+			stops:  []string{"###"},
+			outs:   []string{"a", " #", "#b", "c"},
+			deltas: []string{"a", " ", "##b", "c"},
+			text:   "a ##bc",
+		},
+		{
+			name:   "overlapping stops",
+			stops:  []string{"abce", "bcd"},
+			outs:   []string{"ab", "cd"},
+			deltas: []string{"a"},
+			text:   "a",
+			found:  true,
+		},
+		{
+			name:   "overlapping stop prefixes",
+			stops:  []string{"abce", "bcd"},
+			outs:   []string{"ab", "c", "x"},
+			deltas: []string{"abcx"},
+			text:   "abcx",
+		},
+		{
+			name:      "stop token flushes held text",
+			stops:     []string{"###"},
+			outs:      []string{"Hi", " #", ""},
+			stopToken: true,
+			deltas:    []string{"Hi", " ", "#"},
+			text:      "Hi #",
+		},
+		{
+			name:      "stop token without held text",
+			outs:      []string{"Hi", ""},
+			stopToken: true,
+			deltas:    []string{"Hi", ""},
+			text:      "Hi",
+		},
+	}
+	for _, c := range cases {
+		b := &stopBuffer{stops: c.stops}
+		deltas := make([]string, 0)
+		text, found := "", false
+		for i, out := range c.outs {
+			offset := b.len()
+			text, found = b.write(out)
+			if offset+len(out) != b.len() {
+				t.Errorf("%s: expected length of output %d, got: %d", c.name, offset+len(out), b.len())
+			}
+			final := found || (c.stopToken && i == len(c.outs)-1)
+			if delta, ok := b.next(text, final); ok {
+				deltas = append(deltas, delta)
+			}
+			if final {
+				break
+			}
+		}
+		if text != c.text || found != c.found {
+			t.Errorf("%s: expected text %q, found %v, got: %q, %v", c.name, c.text, c.found, text, found)
+		}
+		if !reflect.DeepEqual(deltas, c.deltas) {
+			t.Errorf("%s: expected deltas %q, got: %q", c.name, c.deltas, deltas)
+		}
+	}
+}
+
+func TestBestChoices(t *testing.T) {
+	newChoices := func() []*choice {
+		return []*choice{
+			{index: 0, text: "a", logprob: -3},
+			{index: 1, text: "b", logprob: -1},
+			{index: 2, text: "c", logprob: -2},
+			{index: 3, text: "d", logprob: -1},
+		}
+	}
+	texts := func(choices []*choice) ([]string, []int) {
+		result := make([]string, 0, len(choices))
+		indexes := make([]int, 0, len(choices))
+		for _, c := range choices {
+			result = append(result, c.text)
+			indexes = append(indexes, c.index)
+		}
+		return result, indexes
+	}
+
+	cases := []struct {
+		n       int
+		texts   []string
+		indexes []int
+	}{
+		// ties keep generation order
+		{n: 2, texts: []string{"b", "d"}, indexes: []int{0, 1}},
+		{n: 3, texts: []string{"b", "d", "c"}, indexes: []int{0, 1, 2}},
+		{n: 1, texts: []string{"b"}, indexes: []int{0}},
+		// without candidates beyond n, choices are kept in generation order
+		{n: 4, texts: []string{"a", "b", "c", "d"}, indexes: []int{0, 1, 2, 3}},
+		{n: 5, texts: []string{"a", "b", "c", "d"}, indexes: []int{0, 1, 2, 3}},
+	}
+	for _, c := range cases {
+		gotTexts, gotIndexes := texts(bestChoices(newChoices(), c.n))
+		if !reflect.DeepEqual(gotTexts, c.texts) || !reflect.DeepEqual(gotIndexes, c.indexes) {
+			t.Errorf("n %d: expected %v %v, got: %v %v", c.n, c.texts, c.indexes, gotTexts, gotIndexes)
+		}
+	}
+}
+
+func TestTopLogprobs(t *testing.T) {
+	logits := []float32{1, 3, 3, 2, 3, -1}
+	cases := []struct {
+		n   int
+		top []binding.Token
+	}{
+		{n: 0, top: []binding.Token{}},
+		{n: 1, top: []binding.Token{1}},
+		// ties are ranked by token id, a later tie does not replace an earlier one
+		{n: 2, top: []binding.Token{1, 2}},
+		{n: 4, top: []binding.Token{1, 2, 4, 3}},
+		{n: 10, top: []binding.Token{1, 2, 4, 3, 0, 5}},
+	}
+	for _, c := range cases {
+		if top := topLogprobs(logits, c.n); !reflect.DeepEqual(top, c.top) {
+			t.Errorf("n %d: expected %v, got: %v", c.n, c.top, top)
+		}
+	}
+}
@@ -0,0 +1,717 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+)
+
+type grammarElementType int
+
+const (
+	// grammarEnd is the end of rule definition
+	grammarEnd grammarElementType = iota
+	// grammarAlt is the start of an alternate definition
+	grammarAlt
+	// grammarRuleRef is a non-terminal element, value is rule id
+	grammarRuleRef
+	// grammarChar is a terminal character, or the start of a character set
+	grammarChar
+	// grammarCharNot is the start of an inverse character set
+	grammarCharNot
+	// grammarCharRngUpper is the inclusive upper bound of a range, previous element is the lower bound
+	grammarCharRngUpper
+	// grammarCharAlt is an alternate character of a character set
+	grammarCharAlt
+)
+
+type grammarElement struct {
+	typ   grammarElementType
+	value rune
+}
+
+// grammarPos points to an element of grammar rules
+type grammarPos struct {
+	rule, elem int
+}
+
+// Grammar is a parsed GBNF grammar, generation starts from rule root
+type Grammar struct {
+	rules  [][]grammarElement
+	rootID int
+}
+
+// ParseGrammar parses GBNF grammar text, for example:
+//
+//	root   ::= answer "."
+//	answer ::= "yes" | "no"
+func ParseGrammar(text string) (*Grammar, error) {
+	p := &grammarParser{src: []rune(text), symbolIDs: map[string]int{}}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	rootID, ok := p.symbolIDs["root"]
+	if !ok {
+		return nil, fmt.Errorf("grammar does not contain a root rule")
+	}
+
+	for name, id := range p.symbolIDs {
+		if id >= len(p.rules) || p.rules[id] == nil {
+			return nil, fmt.Errorf("undefined grammar rule: %s", name)
+		}
+	}
+
+	g := &Grammar{rules: p.rules, rootID: rootID}
+	if name, ok := g.leftRecursion(p.symbolIDs); ok {
+		return nil, fmt.Errorf("left recursion is not supported, rule: %s", name)
+	}
+	return g, nil
+}
+
+// NewState returns a GrammarState at the start of grammar, each generation should use its own state
+func (g *Grammar) NewState() *GrammarState {
+	s := &GrammarState{grammar: g}
+	pos := grammarPos{rule: g.rootID}
+	for {
+		stack := make([]grammarPos, 0)
+		if !g.isEndOfSequence(pos) {
+			stack = append(stack, pos)
+		}
+		s.stacks = g.advanceStack(stack, s.stacks)
+		pos = g.nextAlternate(pos)
+		if g.element(pos).typ != grammarAlt {
+			break
+		}
+		pos.elem++
+	}
+	return s
+}
+
+func (g *Grammar) element(pos grammarPos) grammarElement {
+	return g.rules[pos.rule][pos.elem]
+}
+
+func (g *Grammar) isEndOfSequence(pos grammarPos) bool {
+	typ := g.element(pos).typ
+	return typ == grammarEnd || typ == grammarAlt
+}
+
+// nextAlternate returns the end of the alternate pos belongs to
+func (g *Grammar) nextAlternate(pos grammarPos) grammarPos {
+	for !g.isEndOfSequence(pos) {
+		pos.elem++
+	}
+	return pos
+}
+
+// matchChar returns if the character set at pos matches r, and the position after the character set
+func (g *Grammar) matchChar(pos grammarPos, r rune) (bool, grammarPos) {
+	positive := g.element(pos).typ == grammarChar
+	found := false
+	for {
+		e := g.element(pos)
+		next := g.rules[pos.rule][pos.elem+1]
+		if next.typ == grammarCharRngUpper {
+			found = found || (e.value <= r && r <= next.value)
+			pos.elem += 2
+		} else {
+			found = found || e.value == r
+			pos.elem++
+		}
+		if g.element(pos).typ != grammarCharAlt {
+			break
+		}
+	}
+	return found == positive, pos
+}
+
+// advanceStack expands rule references at the top of stack, until every stack in result is empty or
+// has a character set at top
+func (g *Grammar) advanceStack(stack []grammarPos, result [][]grammarPos) [][]grammarPos {
+	if len(stack) == 0 {
+		return appendStack(result, stack)
+	}
+
+	pos := stack[len(stack)-1]
+	e := g.element(pos)
+	if e.typ != grammarRuleRef {
+		return appendStack(result, stack)
+	}
+
+	subpos := grammarPos{rule: int(e.value)}
+	for {
+		newStack := make([]grammarPos, len(stack)-1, len(stack)+1)
+		copy(newStack, stack)
+		next := grammarPos{rule: pos.rule, elem: pos.elem + 1}
+		if !g.isEndOfSequence(next) {
+			newStack = append(newStack, next)
+		}
+		if !g.isEndOfSequence(subpos) {
+			newStack = append(newStack, subpos)
+		}
+		result = g.advanceStack(newStack, result)
+
+		subpos = g.nextAlternate(subpos)
+		if g.element(subpos).typ != grammarAlt {
+			break
+		}
+		subpos.elem++
+	}
+	return result
+}
+
+// acceptRune returns stacks after r is accepted
+func (g *Grammar) acceptRune(stacks [][]grammarPos, r rune) [][]grammarPos {
+	result := make([][]grammarPos, 0)
+	for _, stack := range stacks {
+		if len(stack) == 0 {
+			continue
+		}
+		ok, next := g.matchChar(stack[len(stack)-1], r)
+		if !ok {
+			continue
+		}
+		newStack := make([]grammarPos, len(stack)-1, len(stack))
+		copy(newStack, stack)
+		if !g.isEndOfSequence(next) {
+			newStack = append(newStack, next)
+		}
+		result = g.advanceStack(newStack, result)
+	}
+	return result
+}
+
+// grammarCandidate is a candidate token with runes not yet matched
+type grammarCandidate struct {
+	index int
+	runes []rune
+}
+
+// rejectCandidates returns candidates which are rejected by all stacks
+func (g *Grammar) rejectCandidates(stacks [][]grammarPos, candidates []grammarCandidate) []grammarCandidate {
+	if len(candidates) == 0 || len(stacks) == 0 {
+		return candidates
+	}
+	rejects := g.rejectCandidatesForStack(stacks[0], candidates)
+	for _, stack := range stacks[1:] {
+		rejects = g.rejectCandidatesForStack(stack, rejects)
+	}
+	return rejects
+}
+
+func (g *Grammar) rejectCandidatesForStack(stack []grammarPos, candidates []grammarCandidate) []grammarCandidate {
+	rejects := make([]grammarCandidate, 0)
+
+	if len(stack) == 0 {
+		for _, c := range candidates {
+			if len(c.runes) > 0 {
+				rejects = append(rejects, c)
+			}
+		}
+		return rejects
+	}
+
+	top := stack[len(stack)-1]
+	nextCandidates := make([]grammarCandidate, 0)
+	for _, c := range candidates {
+		if len(c.runes) == 0 {
+			continue
+		}
+		if ok, _ := g.matchChar(top, c.runes[0]); ok {
+			nextCandidates = append(nextCandidates, grammarCandidate{index: c.index, runes: c.runes[1:]})
+		} else {
+			rejects = append(rejects, c)
+		}
+	}
+
+	if len(nextCandidates) == 0 {
+		return rejects
+	}
+
+	// the position after a character set does not depend on the matched character
+	_, next := g.matchChar(top, 0)
+	newStack := make([]grammarPos, len(stack)-1, len(stack))
+	copy(newStack, stack)
+	if !g.isEndOfSequence(next) {
+		newStack = append(newStack, next)
+	}
+	nextStacks := g.advanceStack(newStack, nil)
+
+	nextRejects := g.rejectCandidates(nextStacks, nextCandidates)
+	rejected := map[int]bool{}
+	for _, c := range nextRejects {
+		rejected[c.index] = true
+	}
+	for _, c := range candidates {
+		if rejected[c.index] {
+			rejects = append(rejects, c)
+		}
+	}
+	return rejects
+}
+
+// leftRecursion returns the name of a left recursive rule if found
+func (g *Grammar) leftRecursion(symbolIDs map[string]int) (string, bool) {
+	nullable := make([]bool, len(g.rules))
+	for changed := true; changed; {
+		changed = false
+		for id, rule := range g.rules {
+			if nullable[id] {
+				continue
+			}
+			for _, alt := range g.alternates(rule) {
+				allNullable := true
+				for _, e := range alt {
+					if e.typ != grammarRuleRef || !nullable[e.value] {
+						allNullable = false
+						break
+					}
+				}
+				if allNullable {
+					nullable[id] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	visited := make([]bool, len(g.rules))
+	inProgress := make([]bool, len(g.rules))
+	var detect func(id int) bool
+	detect = func(id int) bool {
+		if inProgress[id] {
+			return true
+		}
+		if visited[id] {
+			return false
+		}
+		visited[id] = true
+		inProgress[id] = true
+		defer func() { inProgress[id] = false }()
+		for _, alt := range g.alternates(g.rules[id]) {
+			for _, e := range alt {
+				if e.typ != grammarRuleRef {
+					break
+				}
+				if detect(int(e.value)) {
+					return true
+				}
+				if !nullable[e.value] {
+					break
+				}
+			}
+		}
+		return false
+	}
+
+	for name, id := range symbolIDs {
+		if detect(id) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// alternates splits rule into its alternates
+func (g *Grammar) alternates(rule []grammarElement) [][]grammarElement {
+	result := make([][]grammarElement, 0)
+	start := 0
+	for i, e := range rule {
+		if e.typ == grammarAlt || e.typ == grammarEnd {
+			result = append(result, rule[start:i])
+			start = i + 1
+		}
+	}
+	return result
+}
+
+func appendStack(stacks [][]grammarPos, stack []grammarPos) [][]grammarPos {
+	for _, s := range stacks {
+		if equalStack(s, stack) {
+			return stacks
+		}
+	}
+	return append(stacks, stack)
+}
+
+func equalStack(a, b []grammarPos) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// GrammarState tracks generated text under a grammar, and rejects tokens which break the grammar
+type GrammarState struct {
+	grammar *Grammar
+	stacks  [][]grammarPos
+	// partial holds bytes of an incomplete utf8 character of accepted tokens
+	partial []byte
+}
+
+// Done returns if the generated text is a complete sentence of grammar
+func (s *GrammarState) Done() bool {
+	for _, stack := range s.stacks {
+		if len(stack) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept advances the state with text of a sampled token
+func (s *GrammarState) Accept(text string) error {
+	runes, partial := decodeRunes(append(s.partial, text...))
+	stacks := s.stacks
+	for _, r := range runes {
+		stacks = s.grammar.acceptRune(stacks, r)
+		if len(stacks) == 0 {
+			return fmt.Errorf("text is not accepted by grammar: %q", text)
+		}
+	}
+	s.stacks = stacks
+	s.partial = partial
+	return nil
+}
+
+// Apply disables candidates which are not accepted by grammar, vocab is text of all tokens
+func (s *GrammarState) Apply(candidates []binding.TokenData, vocab []string) {
+	eos := binding.TokenEos()
+	done := s.Done()
+
+	grammarCandidates := make([]grammarCandidate, 0, len(candidates))
+	for i := range candidates {
+		id := binding.Token(candidates[i].ID())
+		if id == eos {
+			if !done {
+				candidates[i].SetLogit(negativeInf)
+			}
+			continue
+		}
+		text := vocab[id]
+		if text == "" {
+			candidates[i].SetLogit(negativeInf)
+			continue
+		}
+		runes, _ := decodeRunes(append(s.partial[:len(s.partial):len(s.partial)], text...))
+		if runes == nil {
+			candidates[i].SetLogit(negativeInf)
+			continue
+		}
+		grammarCandidates = append(grammarCandidates, grammarCandidate{index: i, runes: runes})
+	}
+
+	for _, c := range s.grammar.rejectCandidates(s.stacks, grammarCandidates) {
+		candidates[c.index].SetLogit(negativeInf)
+	}
+}
+
+// decodeRunes decodes complete utf8 characters of data, and returns the bytes of a trailing incomplete character,
+// nil runes is returned when data is invalid utf8
+func decodeRunes(data []byte) ([]rune, []byte) {
+	runes := make([]rune, 0, len(data))
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 {
+			if !utf8.FullRune(data) {
+				return runes, data
+			}
+			return nil, nil
+		}
+		runes = append(runes, r)
+		data = data[size:]
+	}
+	return runes, nil
+}
+
+type grammarParser struct {
+	src       []rune
+	pos       int
+	symbolIDs map[string]int
+	rules     [][]grammarElement
+}
+
+func (p *grammarParser) parse() error {
+	p.parseSpace(true)
+	for p.pos < len(p.src) {
+		if err := p.parseRule(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *grammarParser) peek(offset int) rune {
+	if p.pos+offset < len(p.src) {
+		return p.src[p.pos+offset]
+	}
+	return 0
+}
+
+func (p *grammarParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("failed to parse grammar at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *grammarParser) symbolID(name string) int {
+	if id, ok := p.symbolIDs[name]; ok {
+		return id
+	}
+	id := len(p.symbolIDs)
+	p.symbolIDs[name] = id
+	return id
+}
+
+func (p *grammarParser) generateSymbolID(baseName string) int {
+	id := len(p.symbolIDs)
+	p.symbolIDs[baseName+"_"+strconv.Itoa(id)] = id
+	return id
+}
+
+func (p *grammarParser) addRule(id int, rule []grammarElement) {
+	for len(p.rules) <= id {
+		p.rules = append(p.rules, nil)
+	}
+	p.rules[id] = rule
+}
+
+func (p *grammarParser) parseSpace(newlineOK bool) {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || (newlineOK && (c == '\r' || c == '\n')) {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\r' && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+}
+
+func isWordChar(c rune) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '-' || ('0' <= c && c <= '9')
+}
+
+func (p *grammarParser) parseName() (string, error) {
+	start := p.pos
+	for p.pos < len(p.src) && isWordChar(p.src[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expecting name")
+	}
+	return string(p.src[start:p.pos]), nil
+}
+
+func (p *grammarParser) parseChar() (rune, error) {
+	if p.pos >= len(p.src) {
+		return 0, p.errorf("unexpected end of input")
+	}
+	c := p.src[p.pos]
+	if c != '\\' {
+		p.pos++
+		return c, nil
+	}
+	switch p.peek(1) {
+	case 'x':
+		return p.parseHex(2)
+	case 'u':
+		return p.parseHex(4)
+	case 'U':
+		return p.parseHex(8)
+	case 't':
+		p.pos += 2
+		return '\t', nil
+	case 'r':
+		p.pos += 2
+		return '\r', nil
+	case 'n':
+		p.pos += 2
+		return '\n', nil
+	case '\\', '"', '[', ']':
+		escaped := p.peek(1)
+		p.pos += 2
+		return escaped, nil
+	}
+	return 0, p.errorf("unknown escape: \\%c", p.peek(1))
+}
+
+func (p *grammarParser) parseHex(size int) (rune, error) {
+	start := p.pos + 2
+	end := start + size
+	if end > len(p.src) {
+		return 0, p.errorf("expecting %d hex chars", size)
+	}
+	value, err := strconv.ParseUint(string(p.src[start:end]), 16, 32)
+	if err != nil {
+		return 0, p.errorf("expecting %d hex chars", size)
+	}
+	p.pos = end
+	return rune(value), nil
+}
+
+func (p *grammarParser) parseSequence(ruleName string, elements []grammarElement, nested bool) ([]grammarElement, error) {
+	lastSymStart := len(elements)
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			lastSymStart = len(elements)
+			for p.peek(0) != '"' {
+				r, err := p.parseChar()
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, grammarElement{typ: grammarChar, value: r})
+			}
+			p.pos++
+			p.parseSpace(nested)
+		case c == '[':
+			p.pos++
+			startType := grammarChar
+			if p.peek(0) == '^' {
+				p.pos++
+				startType = grammarCharNot
+			}
+			lastSymStart = len(elements)
+			for p.peek(0) != ']' {
+				r, err := p.parseChar()
+				if err != nil {
+					return nil, err
+				}
+				typ := startType
+				if lastSymStart < len(elements) {
+					typ = grammarCharAlt
+				}
+				elements = append(elements, grammarElement{typ: typ, value: r})
+				if p.peek(0) == '-' && p.peek(1) != ']' {
+					p.pos++
+					upper, err := p.parseChar()
+					if err != nil {
+						return nil, err
+					}
+					elements = append(elements, grammarElement{typ: grammarCharRngUpper, value: upper})
+				}
+			}
+			p.pos++
+			p.parseSpace(nested)
+		case isWordChar(c):
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			refID := p.symbolID(name)
+			p.parseSpace(nested)
+			lastSymStart = len(elements)
+			elements = append(elements, grammarElement{typ: grammarRuleRef, value: rune(refID)})
+		case c == '(':
+			p.pos++
+			p.parseSpace(true)
+			subID := p.generateSymbolID(ruleName)
+			if err := p.parseAlternates(ruleName, subID, true); err != nil {
+				return nil, err
+			}
+			lastSymStart = len(elements)
+			elements = append(elements, grammarElement{typ: grammarRuleRef, value: rune(subID)})
+			if p.peek(0) != ')' {
+				return nil, p.errorf("expecting ')'")
+			}
+			p.pos++
+			p.parseSpace(nested)
+		case c == '*' || c == '+' || c == '?':
+			if lastSymStart == len(elements) {
+				return nil, p.errorf("expecting preceding item to */+/?")
+			}
+			// S* --> S' ::= S S' |
+			// S+ --> S' ::= S S' | S
+			// S? --> S' ::= S |
+			subID := p.generateSymbolID(ruleName)
+			item := elements[lastSymStart:]
+			subRule := append([]grammarElement{}, item...)
+			if c == '*' || c == '+' {
+				subRule = append(subRule, grammarElement{typ: grammarRuleRef, value: rune(subID)})
+			}
+			subRule = append(subRule, grammarElement{typ: grammarAlt})
+			if c == '+' {
+				subRule = append(subRule, item...)
+			}
+			subRule = append(subRule, grammarElement{typ: grammarEnd})
+			p.addRule(subID, subRule)
+
+			elements = append(elements[:lastSymStart], grammarElement{typ: grammarRuleRef, value: rune(subID)})
+			p.pos++
+			p.parseSpace(nested)
+		default:
+			return elements, nil
+		}
+	}
+	if nested {
+		return nil, p.errorf("unexpected end of input")
+	}
+	return elements, nil
+}
+
+func (p *grammarParser) parseAlternates(ruleName string, ruleID int, nested bool) error {
+	rule, err := p.parseSequence(ruleName, make([]grammarElement, 0), nested)
+	if err != nil {
+		return err
+	}
+	for p.peek(0) == '|' {
+		rule = append(rule, grammarElement{typ: grammarAlt})
+		p.pos++
+		p.parseSpace(true)
+		rule, err = p.parseSequence(ruleName, rule, nested)
+		if err != nil {
+			return err
+		}
+	}
+	rule = append(rule, grammarElement{typ: grammarEnd})
+	p.addRule(ruleID, rule)
+	return nil
+}
+
+func (p *grammarParser) parseRule() error {
+	name, err := p.parseName()
+	if err != nil {
+		return err
+	}
+	p.parseSpace(false)
+	ruleID := p.symbolID(name)
+
+	if !strings.HasPrefix(string(p.src[p.pos:]), "::=") {
+		return p.errorf("expecting ::=")
+	}
+	p.pos += 3
+	p.parseSpace(true)
+
+	if err := p.parseAlternates(name, ruleID, false); err != nil {
+		return err
+	}
+
+	switch p.peek(0) {
+	case '\r':
+		p.pos++
+		if p.peek(0) == '\n' {
+			p.pos++
+		}
+	case '\n':
+		p.pos++
+	case 0:
+	default:
+		return p.errorf("expecting newline or end")
+	}
+	p.parseSpace(true)
+	return nil
+}
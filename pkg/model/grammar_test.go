@@ -0,0 +1,249 @@
+package model
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+)
+
+// accepts returns if text is a complete sentence of grammar
+func accepts(g *Grammar, text string) bool {
+	s := g.NewState()
+	return s.Accept(text) == nil && s.Done()
+}
+
+func TestParseGrammar(t *testing.T) {
+	tests := []struct {
+		name     string
+		grammar  string
+		accepted []string
+		rejected []string
+	}{
+		{
+			name:     "alternation",
+			grammar:  `root ::= "yes" | "no"`,
+			accepted: []string{"yes", "no"},
+			rejected: []string{"", "y", "yesno", "maybe"},
+		},
+		{
+			name: "rule reference",
+			grammar: `root   ::= answer "."
+answer ::= "yes" | "no"`,
+			accepted: []string{"yes.", "no."},
+			rejected: []string{"yes", ".", "no!"},
+		},
+		{
+			name:     "star",
+			grammar:  `root ::= "a" "b"*`,
+			accepted: []string{"a", "ab", "abbb"},
+			rejected: []string{"", "b", "aba"},
+		},
+		{
+			name:     "plus",
+			grammar:  `root ::= "a"+`,
+			accepted: []string{"a", "aaa"},
+			rejected: []string{"", "ab"},
+		},
+		{
+			name:     "optional",
+			grammar:  `root ::= "a" "b"? "c"`,
+			accepted: []string{"ac", "abc"},
+			rejected: []string{"abbc", "a"},
+		},
+		{
+			name:     "group",
+			grammar:  `root ::= ("ab" | "c")+ "."`,
+			accepted: []string{"ab.", "cab.", "abcc."},
+			rejected: []string{"a.", "."},
+		},
+		{
+			name:     "char class",
+			grammar:  `root ::= [a-c0-9_]+`,
+			accepted: []string{"a", "cab", "a1_9"},
+			rejected: []string{"d", "A", "a-b"},
+		},
+		{
+			name:     "negated char class",
+			grammar:  `root ::= "\"" [^"\\]* "\""`,
+			accepted: []string{`""`, `"abc"`, `"a b"`},
+			rejected: []string{`"a"b"`, `"\"`},
+		},
+		{
+			name:     "escapes",
+			grammar:  `root ::= "\x41é\n\t"`,
+			accepted: []string{"Aé\n\t"},
+			rejected: []string{"A\n\t"},
+		},
+		{
+			name: "comments",
+			grammar: `# a comment
+root ::= "a" # trailing comment
+`,
+			accepted: []string{"a"},
+			rejected: []string{"# a comment"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := ParseGrammar(tt.grammar)
+			if err != nil {
+				t.Fatalf("failed to parse grammar, err: %v", err)
+			}
+			for _, text := range tt.accepted {
+				if !accepts(g, text) {
+					t.Errorf("expected %q to be accepted", text)
+				}
+			}
+			for _, text := range tt.rejected {
+				if accepts(g, text) {
+					t.Errorf("expected %q to be rejected", text)
+				}
+			}
+		})
+	}
+}
+
+func TestParseGrammarErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		grammar string
+		err     string
+	}{
+		{name: "missing root", grammar: `answer ::= "yes"`, err: "root rule"},
+		{name: "undefined rule", grammar: `root ::= answer`, err: "undefined grammar rule: answer"},
+		{name: "missing definition", grammar: `root "yes"`, err: "expecting ::="},
+		{name: "unclosed group", grammar: `root ::= ("a"`, err: "unexpected end of input"},
+		{name: "dangling repetition", grammar: `root ::= *`, err: "expecting preceding item"},
+		{name: "unknown escape", grammar: `root ::= "\q"`, err: "unknown escape"},
+		{name: "left recursion", grammar: `root ::= root "a" | "a"`, err: "left recursion"},
+		{
+			name: "indirect left recursion",
+			grammar: `root ::= expr
+expr ::= term "+" expr | term
+term ::= expr "*" | "x"`,
+			err: "left recursion",
+		},
+		{
+			name: "left recursion after nullable",
+			grammar: `root ::= opt root "a" | "a"
+opt  ::= "b"?`,
+			err: "left recursion",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseGrammar(tt.grammar)
+			if err == nil {
+				t.Fatalf("expected error containing %q", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestGrammarStateAccept(t *testing.T) {
+	g, err := ParseGrammar(`root ::= "{" [0-9]+ "}"`)
+	if err != nil {
+		t.Fatalf("failed to parse grammar, err: %v", err)
+	}
+	s := g.NewState()
+	for _, text := range []string{"{", "1", "23"} {
+		if err := s.Accept(text); err != nil {
+			t.Fatalf("failed to accept %q, err: %v", text, err)
+		}
+		if s.Done() {
+			t.Fatalf("expected state not done after %q", text)
+		}
+	}
+	if err := s.Accept("x"); err == nil {
+		t.Fatal("expected error accepting x")
+	}
+	// a rejected token leaves state unchanged
+	if err := s.Accept("}"); err != nil {
+		t.Fatalf("failed to accept }, err: %v", err)
+	}
+	if !s.Done() {
+		t.Fatal("expected state done")
+	}
+}
+
+func TestGrammarStateAcceptPartialRune(t *testing.T) {
+	g, err := ParseGrammar(`root ::= "é"`)
+	if err != nil {
+		t.Fatalf("failed to parse grammar, err: %v", err)
+	}
+	s := g.NewState()
+	text := "é"
+	if err := s.Accept(text[:1]); err != nil {
+		t.Fatalf("failed to accept first byte, err: %v", err)
+	}
+	if s.Done() {
+		t.Fatal("expected state not done with partial rune")
+	}
+	if err := s.Accept(text[1:]); err != nil {
+		t.Fatalf("failed to accept second byte, err: %v", err)
+	}
+	if !s.Done() {
+		t.Fatal("expected state done")
+	}
+}
+
+func TestGrammarStateApply(t *testing.T) {
+	g, err := ParseGrammar(`root ::= "yes" | "no"`)
+	if err != nil {
+		t.Fatalf("failed to parse grammar, err: %v", err)
+	}
+	vocab := make([]string, 8)
+	vocab[3], vocab[4], vocab[5], vocab[6] = "yes", "no", "y", "maybe"
+	eos := int(binding.TokenEos())
+	vocab[eos] = "</s>"
+
+	allowed := func(s *GrammarState) map[string]bool {
+		candidates := make([]binding.TokenData, len(vocab))
+		for i := range candidates {
+			candidates[i].SetID(int32(i))
+		}
+		s.Apply(candidates, vocab)
+		result := map[string]bool{}
+		for i := range candidates {
+			if !math.IsInf(float64(candidates[i].Logit()), -1) {
+				result[vocab[i]] = true
+			}
+		}
+		return result
+	}
+
+	s := g.NewState()
+	got := allowed(s)
+	for _, text := range []string{"yes", "no", "y"} {
+		if !got[text] {
+			t.Errorf("expected %q to be allowed at start", text)
+		}
+	}
+	for _, text := range []string{"maybe", "</s>", ""} {
+		if got[text] {
+			t.Errorf("expected %q to be disabled at start", text)
+		}
+	}
+
+	if err := s.Accept("y"); err != nil {
+		t.Fatalf("failed to accept y, err: %v", err)
+	}
+	got = allowed(s)
+	if len(got) != 0 {
+		t.Errorf("expected no candidate after y, got: %v", got)
+	}
+
+	s = g.NewState()
+	if err := s.Accept("no"); err != nil {
+		t.Fatalf("failed to accept no, err: %v", err)
+	}
+	got = allowed(s)
+	if len(got) != 1 || !got["</s>"] {
+		t.Errorf("expected only eos after no, got: %v", got)
+	}
+}
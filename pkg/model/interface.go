@@ -13,24 +13,48 @@ type Model interface {
 	Tokenize(text string, addBos bool) ([]binding.Token, error)
 	// Detokenize converts tokens to string
 	Detokenize(tokens []binding.Token) string
+	// Vocab returns text of all tokens, indexed by token
+	Vocab() []string
 	// Reset model context
 	Reset()
 	// Eval prompt tokens
 	Eval(tokens []binding.Token) error
-	// Sample a token
-	Sample(options ...SampleOption) binding.Token
+	// Tokens returns evaluated tokens
+	Tokens() []binding.Token
+	// Rewind drops evaluated tokens after pastNum, so that the evaluated prefix can be reused
+	Rewind(pastNum int)
+	// Shift discards half of evaluated tokens after the first keepNum, and evaluates the rest again after them,
+	// so that evaluation continues when context is full
+	Shift(keepNum int) error
+	// SetSeed set seed of random number generator used by sample
+	SetSeed(seed int)
+	// NewSampler returns a sampler for one generation, which should be closed after use
+	NewSampler(options ...SampleOption) (*Sampler, error)
+	// Sample a token with a one-off sampler
+	Sample(options ...SampleOption) (binding.Token, error)
 	// GetEmbedding returns current context embeddings
 	GetEmbedding() ([]float32, error)
 	// ContextSize returns context size
 	ContextSize() int
 	// Logits returns current context logits
 	Logits() [][]float32
-	// SaveSession stores all context into file
-	SaveSession(filepath string) error
-	// LoadSession loads all context from file
-	LoadSession(filepath string, tokens []binding.Token) (int, error)
+	// SaveState returns a snapshot of context in memory
+	SaveState() (*State, error)
+	// LoadState restores context from state, and returns the number of leading tokens evaluated by state
+	LoadState(state *State, tokens []binding.Token) int
 	// PrintTimings of eval
 	PrintTimings()
 	// ResetTimings of eval
 	ResetTimings()
 }
+
+// State is a snapshot of context, including kv cache and evaluated tokens
+type State struct {
+	Tokens []binding.Token
+	Data   []byte
+}
+
+// Size returns bytes used by state
+func (s *State) Size() int {
+	return len(s.Data) + len(s.Tokens)*4
+}
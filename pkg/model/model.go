@@ -3,7 +3,7 @@ package model
 import (
 	"fmt"
 	"math"
-	"os"
+	"math/rand"
 	"runtime"
 	"strings"
 	"time"
@@ -15,10 +15,16 @@ type model struct {
 	modelPath string
 	params    *Params
 
-	lastNTokensData *TokenRingbuf
-	tokensConsumed  int
-	tokens          []binding.Token
-	pastNum         int
+	tokensConsumed int
+	tokens         []binding.Token
+	pastNum        int
+	// lastBatchNum is the number of tokens evaluated by last eval, which have logits when logits all is enabled
+	lastBatchNum int
+
+	// vocab is text of all tokens, loaded on first use
+	vocab []string
+	// rng is used by go side processors, seeded along with the context
+	rng *rand.Rand
 
 	ctx *binding.Context
 }
@@ -41,9 +47,14 @@ func New(modelPath string, opts ...Option) (Model, error) {
 	l := &model{modelPath: modelPath}
 	l.params = p
 
-	l.lastNTokensData = NewTokenRingBuf(l.params.lastNTokensSize)
 	l.tokens = make([]binding.Token, 0)
 
+	seed := int64(p.Seed())
+	if seed < 0 {
+		seed = time.Now().UnixNano()
+	}
+	l.rng = rand.New(rand.NewSource(seed))
+
 	binding.InitBackend()
 	ctx, err := binding.InitFromFile(modelPath, p.Params)
 	if err != nil {
@@ -91,27 +102,61 @@ func (m *model) Detokenize(tokens []binding.Token) string {
 }
 
 func (m *model) Reset() {
-	m.lastNTokensData = NewTokenRingBuf(m.params.lastNTokensSize)
 	m.tokensConsumed = 0
 	m.tokens = make([]binding.Token, 0)
 	m.pastNum = 0
+	m.lastBatchNum = 0
 	m.ResetTimings()
 }
 
 func (m *model) Eval(tokens []binding.Token) error {
 	nCtx := int(m.ctx.CtxNum())
+	if m.tokensConsumed+len(tokens) > nCtx {
+		return fmt.Errorf("tokens exceeds context size: %d, evaluated: %d, evaluating: %d", nCtx, m.tokensConsumed, len(tokens))
+	}
 	for i := 0; i < len(tokens); i += m.params.batchNum {
 		limit := int(math.Min(float64(len(tokens)), float64(i+m.params.batchNum)))
 		batch := tokens[i:limit]
-		m.pastNum = int(math.Min(float64(nCtx-len(batch)), float64(m.tokensConsumed)))
+		m.pastNum = m.tokensConsumed
 		m.ctx.Eval(batch, int32(m.pastNum), int32(m.params.threadNum))
 		m.tokens = append(m.tokens, batch...)
-		m.lastNTokensData.Write(batch)
 		m.tokensConsumed += len(batch)
+		m.lastBatchNum = len(batch)
 	}
 	return nil
 }
 
+func (m *model) Tokens() []binding.Token {
+	return m.tokens
+}
+
+func (m *model) Rewind(pastNum int) {
+	if pastNum > len(m.tokens) {
+		pastNum = len(m.tokens)
+	}
+	m.tokens = m.tokens[:pastNum]
+	m.pastNum = pastNum
+	m.tokensConsumed = pastNum
+}
+
+func (m *model) Shift(keepNum int) error {
+	if keepNum > len(m.tokens) {
+		keepNum = len(m.tokens)
+	}
+	discardNum := (len(m.tokens) - keepNum) / 2
+	if discardNum == 0 {
+		return fmt.Errorf("no evaluated tokens to discard, keep num: %d, evaluated: %d", keepNum, len(m.tokens))
+	}
+	if m.params.verbose {
+		fmt.Printf("context shift, keep num: %d, discard num: %d\n", keepNum, discardNum)
+	}
+
+	// kv cache of the kept tail depends on positions, so the tail is evaluated again right after the kept head
+	tail := append([]binding.Token(nil), m.tokens[keepNum+discardNum:]...)
+	m.Rewind(keepNum)
+	return m.Eval(tail)
+}
+
 func (m *model) ContextSize() int {
 	return int(m.ctx.CtxNum())
 }
@@ -121,7 +166,7 @@ func (m *model) Logits() [][]float32 {
 	cols := int(nVocab)
 	rows := 1
 	if m.params.logtisAll {
-		rows = len(m.tokens)
+		rows = m.lastBatchNum
 	}
 	logitsView := m.ctx.GetLogits(rows)
 	logtis := make([][]float32, rows)
@@ -136,6 +181,25 @@ func (m *model) Logits() [][]float32 {
 	return logtis
 }
 
+// batchLogits copies logits of the token evaluated by last eval, which is followed by pendingNum tokens, into
+// buf. pendingNum should be less than batchRows.
+func (m *model) batchLogits(buf []float32, pendingNum int) []float32 {
+	cols := int(m.ctx.VocabNum())
+	rows := m.batchRows()
+	logitsView := m.ctx.GetLogits(rows)
+	copy(buf, logitsView[(rows-1-pendingNum)*cols:])
+	return buf[:cols]
+}
+
+// batchRows returns the number of tokens evaluated by last eval which have logits, only the last one has logits
+// unless logits all is enabled
+func (m *model) batchRows() int {
+	if m.params.logtisAll && m.lastBatchNum > 0 {
+		return m.lastBatchNum
+	}
+	return 1
+}
+
 func (m *model) GetEmbedding() ([]float32, error) {
 	if !m.params.embedding {
 		return nil, fmt.Errorf("embedding config is false, should be true to get embedding")
@@ -143,128 +207,72 @@ func (m *model) GetEmbedding() ([]float32, error) {
 	return m.ctx.GetEmbeddings(), nil
 }
 
-func (m *model) Sample(options ...SampleOption) binding.Token {
-	op := &sampleParams{
-		logisBias:        map[binding.Token]float32{},
-		topK:             40,
-		topP:             0.95,
-		tfsZ:             1,
-		typicalP:         1,
-		temp:             0.8,
-		repeatPenalty:    1.1,
-		repeatLastN:      64,
-		frequenctPenalty: 0,
-		presencePenalty:  0,
-		mirostat:         0,
-		mirostatTau:      5,
-		mirostatEta:      0.1,
-	}
-
-	for _, apply := range options {
-		apply(op)
-	}
-
-	logitsAll := m.Logits()
-	logits := logitsAll[len(logitsAll)-1]
-	vocabNum := m.ctx.VocabNum()
-	for k, v := range op.logisBias {
-		logits[k] += v
-	}
-
-	candidatesP := binding.NewTokenDataArray(uint32(vocabNum), false)
-	defer candidatesP.Free()
-	candidates := candidatesP.Data()
-	for i := 0; i < int(vocabNum); i++ {
-		data := binding.TokenData{}
-		data.SetID(int32(i))
-		data.SetLogit(logits[i])
-		data.SetP(0)
-		candidates[i] = data
-	}
-
-	lastNTokensData := make([]binding.Token, m.params.lastNTokensSize)
-	m.lastNTokensData.Read(lastNTokensData)
-
-	lastNRepeat := int(math.Min(math.Min(float64(len(lastNTokensData)), float64(m.params.lastNTokensSize)), float64(m.ctx.CtxNum())))
-
-	lastNtokens := lastNTokensData[len(lastNTokensData)-lastNRepeat:]
-	m.ctx.SampleRepetitionPenalty(candidatesP, lastNtokens, op.repeatPenalty)
-	m.ctx.SampleFrequencyAndPresencePenalties(candidatesP, lastNtokens, op.frequenctPenalty, op.presencePenalty)
-
-	nlLogis := logits[binding.TokenNl()]
-	if !op.penalizeNL {
-		logits[binding.TokenNl()] = nlLogis
-	}
-
-	if op.temp < 0 {
-		return m.ctx.SampleTokenGreedy(candidatesP)
-	}
-
-	if op.mirostat == 1 {
-		mirostatMu := 2 * op.mirostatTau
-		mirostatM := 100
-		m.ctx.SampleTemperature(candidatesP, op.temp)
-		return m.ctx.SampleTokenMirostat(candidatesP, op.mirostatTau, op.mirostatEta, mirostatM, &mirostatMu)
-	}
-
-	if op.mirostat == 2 {
-		mirostatMu := 2 * op.mirostatTau
-		m.ctx.SampleTemperature(candidatesP, op.temp)
-		return m.ctx.SampleTokenMirostatV2(candidatesP, op.mirostatTau, op.mirostatEta, &mirostatMu)
-	}
+func (m *model) SetSeed(seed int) {
+	m.ctx.SetRngSeed(int32(seed))
+	m.rng = rand.New(rand.NewSource(int64(seed)))
+}
 
-	m.ctx.SampleTopK(candidatesP, int32(op.topK), 1)
-	m.ctx.SampleTailFree(candidatesP, op.tfsZ, 1)
-	m.ctx.SampleTypical(candidatesP, op.typicalP, 1)
-	m.ctx.SampleTopP(candidatesP, op.topP, 1)
-	m.ctx.SampleTemperature(candidatesP, op.temp)
-	return m.ctx.SampleToken(candidatesP)
+func (m *model) NewSampler(options ...SampleOption) (*Sampler, error) {
+	return newSampler(m, options...)
 }
 
-func (m *model) SaveSession(filepath string) error {
-	if m.params.verbose {
-		stateTime := time.Now()
-		fmt.Printf("start to save session, filepath: %s\n", filepath)
-		defer func() {
-			fmt.Printf("finished save session, filepath: %s, took: %v\n", filepath, time.Since(stateTime))
-		}()
+func (m *model) Sample(options ...SampleOption) (binding.Token, error) {
+	sampler, err := m.NewSampler(options...)
+	if err != nil {
+		return 0, err
 	}
-	return m.ctx.SaveSessionFile(filepath, m.tokens)
+	defer sampler.Close()
+	return sampler.Sample()
 }
 
-func (m *model) LoadSession(filepath string, tokens []binding.Token) (matchNum int, err error) {
-	if m.params.verbose {
-		stateTime := time.Now()
-		fmt.Printf("start to load session, filepath: %s\n", filepath)
-		defer func() {
-			fmt.Printf("finished load session, filepath: %s, match num: %d, took: %v\n", filepath, matchNum, time.Since(stateTime))
-		}()
+func (m *model) Vocab() []string {
+	if m.vocab == nil {
+		vocabNum := int(m.ctx.VocabNum())
+		vocab := make([]string, vocabNum)
+		for i := 0; i < vocabNum; i++ {
+			vocab[i] = m.ctx.TokenToStr(binding.Token(i))
+		}
+		m.vocab = vocab
 	}
+	return m.vocab
+}
 
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		return 0, nil
+func (m *model) SaveState() (*State, error) {
+	if len(m.tokens) == 0 {
+		return nil, fmt.Errorf("no evaluated tokens to save")
 	}
+	data := make([]byte, m.ctx.GetStateSize())
+	n := m.ctx.CopyStateData(data)
+	tokens := make([]binding.Token, len(m.tokens))
+	copy(tokens, m.tokens)
+	return &State{Tokens: tokens, Data: data[:n]}, nil
+}
 
+func (m *model) LoadState(state *State, tokens []binding.Token) int {
 	m.Reset()
-
-	sessionTokens, err := m.ctx.LoadSessionFile(filepath)
-	if err != nil {
-		return 0, err
+	if state == nil || len(state.Data) == 0 {
+		return 0
+	}
+	// a state of another context does not fit, restoring it would read beyond kv cache
+	if len(state.Data) > int(m.ctx.GetStateSize()) || len(state.Tokens) > m.ContextSize() {
+		return 0
 	}
 
-	min := int(math.Min(float64(len(tokens)), float64(len(sessionTokens))))
 	index := 0
-	for ; index < min-1; index++ {
-		if sessionTokens[index] != tokens[index] {
+	for ; index < len(state.Tokens) && index < len(tokens)-1; index++ {
+		if state.Tokens[index] != tokens[index] {
 			break
 		}
 	}
+	if index == 0 {
+		return 0
+	}
 
+	m.ctx.SetStateData(state.Data)
 	m.pastNum = index
 	m.tokensConsumed = index
-	m.tokens = tokens[:index]
-	m.lastNTokensData.Write(m.tokens)
-	return index, nil
+	m.tokens = append(m.tokens, tokens[:index]...)
+	return index
 }
 
 func (m *model) PrintTimings() {
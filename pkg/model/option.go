@@ -90,7 +90,7 @@ func WithBatchNum(batchNum int) Option {
 	}
 }
 
-// WithLastNTokensSize set last token size used by sample
+// WithLastNTokensSize set default number of last tokens penalized by sample
 func WithLastNTokensSize(lastNTokensSize int) Option {
 	return func(p *Params) {
 		p.lastNTokensSize = lastNTokensSize
@@ -140,6 +140,27 @@ type sampleParams struct {
 	mirostatTau      float32
 	mirostatEta      float32
 	penalizeNL       bool
+	grammar          *GrammarState
+	processors       []string
+	minP             float32
+	topA             float32
+	dryMultiplier    float32
+	dryBase          float32
+	dryAllowedLength int
+	dryPenaltyLastN  int
+	// drySequenceBreakers is the text of sequence breakers
+	drySequenceBreakers []string
+	xtcProbability      float32
+	xtcThreshold        float32
+	// guidance is the context of negative prompt, nil disables classifier-free guidance
+	guidance Model
+	cfgScale float32
+}
+
+// greedy reports whether the most likely token is always sampled. Temperature 0 is greedy too, rather than dividing
+// logits by zero.
+func (sp *sampleParams) greedy() bool {
+	return sp.temp <= 0
 }
 
 // SampleOption for sample operation
@@ -180,7 +201,7 @@ func WithTypicalP(typicalP float32) SampleOption {
 	}
 }
 
-// WithTemp set temperature
+// WithTemp set temperature, 0 or less samples greedily
 func WithTemp(temp float32) SampleOption {
 	return func(sp *sampleParams) {
 		sp.temp = temp
@@ -242,3 +263,94 @@ func WithPenalizeNL(penalizeNL bool) SampleOption {
 		sp.penalizeNL = penalizeNL
 	}
 }
+
+// WithGrammar restricts sampled tokens to those accepted by grammar state, the state is advanced by the sampled token
+func WithGrammar(grammar *GrammarState) SampleOption {
+	return func(sp *sampleParams) {
+		sp.grammar = grammar
+	}
+}
+
+// WithLogitsProcessors set names of logits processors applied in order before a token is sampled, nil means
+// the default processors and an empty slice disables all of them
+func WithLogitsProcessors(names []string) SampleOption {
+	return func(sp *sampleParams) {
+		sp.processors = names
+	}
+}
+
+// WithMinP set min p, candidates less likely than min p times the most likely one are removed
+func WithMinP(minP float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.minP = minP
+	}
+}
+
+// WithTopA set top a, candidates less likely than top a times the squared probability of the most likely one
+// are removed
+func WithTopA(topA float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.topA = topA
+	}
+}
+
+// WithDryMultiplier set dry multiplier, 0 disables dry
+func WithDryMultiplier(dryMultiplier float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.dryMultiplier = dryMultiplier
+	}
+}
+
+// WithDryBase set dry base of exponential penalty
+func WithDryBase(dryBase float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.dryBase = dryBase
+	}
+}
+
+// WithDryAllowedLength set length of repeated sequence which is not penalized by dry
+func WithDryAllowedLength(dryAllowedLength int) SampleOption {
+	return func(sp *sampleParams) {
+		sp.dryAllowedLength = dryAllowedLength
+	}
+}
+
+// WithDryPenaltyLastN set number of last tokens scanned by dry, negative means the whole context. Defaults to
+// last n tokens size like repeat last n.
+func WithDryPenaltyLastN(dryPenaltyLastN int) SampleOption {
+	return func(sp *sampleParams) {
+		sp.dryPenaltyLastN = dryPenaltyLastN
+	}
+}
+
+// WithDrySequenceBreakers set text which stops matching of repeated sequences by dry
+func WithDrySequenceBreakers(drySequenceBreakers []string) SampleOption {
+	return func(sp *sampleParams) {
+		sp.drySequenceBreakers = drySequenceBreakers
+	}
+}
+
+// WithXTCProbability set probability of excluding top choices, 0 disables xtc
+func WithXTCProbability(xtcProbability float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.xtcProbability = xtcProbability
+	}
+}
+
+// WithXTCThreshold set probability above which candidates are top choices of xtc
+func WithXTCThreshold(xtcThreshold float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.xtcThreshold = xtcThreshold
+	}
+}
+
+// WithGuidance enables classifier-free guidance by context of negative prompt, which should have evaluated the
+// same generated tokens. Log probabilities are combined as neg + cfgScale*(pos-neg) before penalties and
+// processors, 1 means no guidance. Creating the sampler fails when guidance is not a context loaded by this
+// package.
+func WithGuidance(guidance Model, cfgScale float32) SampleOption {
+	return func(sp *sampleParams) {
+		sp.guidance = guidance
+		sp.cfgScale = cfgScale
+	}
+}
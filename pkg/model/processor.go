@@ -0,0 +1,97 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+)
+
+// Names of builtin logits processors
+const (
+	ProcessorTopK        = "top_k"
+	ProcessorTailFree    = "tfs_z"
+	ProcessorTypical     = "typical_p"
+	ProcessorTopP        = "top_p"
+	ProcessorTemperature = "temperature"
+	ProcessorMinP        = "min_p"
+	ProcessorTopA        = "top_a"
+	ProcessorDRY         = "dry"
+	ProcessorXTC         = "xtc"
+)
+
+// LogitsProcessor adjusts or filters candidates before a token is sampled. A registered processor is shared
+// by all samplers, so it should not keep state of a generation, which can be read from the sampler.
+type LogitsProcessor interface {
+	Process(s *Sampler, candidates *binding.TokenDataArray)
+}
+
+// LogitsProcessorFunc adapts a function to LogitsProcessor
+type LogitsProcessorFunc func(s *Sampler, candidates *binding.TokenDataArray)
+
+// Process calls f
+func (f LogitsProcessorFunc) Process(s *Sampler, candidates *binding.TokenDataArray) {
+	f(s, candidates)
+}
+
+var (
+	processorsLocker sync.RWMutex
+	processors       = map[string]LogitsProcessor{
+		ProcessorTopK: LogitsProcessorFunc(func(s *Sampler, candidates *binding.TokenDataArray) {
+			s.m.ctx.SampleTopK(candidates, int32(s.params.topK), 1)
+		}),
+		ProcessorTailFree: LogitsProcessorFunc(func(s *Sampler, candidates *binding.TokenDataArray) {
+			s.m.ctx.SampleTailFree(candidates, s.params.tfsZ, 1)
+		}),
+		ProcessorTypical: LogitsProcessorFunc(func(s *Sampler, candidates *binding.TokenDataArray) {
+			s.m.ctx.SampleTypical(candidates, s.params.typicalP, 1)
+		}),
+		ProcessorTopP: LogitsProcessorFunc(func(s *Sampler, candidates *binding.TokenDataArray) {
+			s.m.ctx.SampleTopP(candidates, s.params.topP, 1)
+		}),
+		ProcessorTemperature: LogitsProcessorFunc(func(s *Sampler, candidates *binding.TokenDataArray) {
+			s.m.ctx.SampleTemperature(candidates, s.params.temp)
+		}),
+		ProcessorMinP: LogitsProcessorFunc(sampleMinP),
+		ProcessorTopA: LogitsProcessorFunc(sampleTopA),
+		ProcessorDRY:  LogitsProcessorFunc(sampleDRY),
+		ProcessorXTC:  LogitsProcessorFunc(sampleXTC),
+	}
+)
+
+// DefaultLogitsProcessors returns names of the processors applied when none is configured, in order
+func DefaultLogitsProcessors() []string {
+	return []string{
+		ProcessorDRY, ProcessorTopK, ProcessorTailFree, ProcessorTypical, ProcessorTopP,
+		ProcessorMinP, ProcessorTopA, ProcessorXTC, ProcessorTemperature,
+	}
+}
+
+// RegisterLogitsProcessor registers processor by name, so that it can be put into the chain of processors.
+// Registering an existing name replaces the processor.
+func RegisterLogitsProcessor(name string, processor LogitsProcessor) {
+	processorsLocker.Lock()
+	defer processorsLocker.Unlock()
+	processors[name] = processor
+}
+
+// ValidateLogitsProcessors checks that all names are registered processors
+func ValidateLogitsProcessors(names []string) error {
+	_, err := lookupLogitsProcessors(names)
+	return err
+}
+
+func lookupLogitsProcessors(names []string) ([]LogitsProcessor, error) {
+	processorsLocker.RLock()
+	defer processorsLocker.RUnlock()
+
+	chain := make([]LogitsProcessor, 0, len(names))
+	for _, name := range names {
+		processor, ok := processors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown logits processor: %s", name)
+		}
+		chain = append(chain, processor)
+	}
+	return chain, nil
+}
@@ -0,0 +1,227 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+)
+
+// mirostatM is the number of most likely tokens used by mirostat v1 to estimate s_hat
+const mirostatM = 100
+
+// Sampler samples tokens of one generation. It carries mirostat mu across tokens and reuses its buffers,
+// so it should be created once per generation and closed after it.
+type Sampler struct {
+	m      *model
+	params *sampleParams
+
+	mirostatMu float32
+	processors []LogitsProcessor
+	// pendingNum is the number of evaluated tokens after the one being sampled for, which are not seen by it
+	pendingNum int
+	// dryBreakers is tokens containing dry sequence breakers
+	dryBreakers map[binding.Token]bool
+
+	logits     []float32
+	candidates *binding.TokenDataArray
+	// guidance is the context of negative prompt
+	guidance *model
+	// guidanceLogits is buffer of logits of guidance context
+	guidanceLogits []float32
+}
+
+func newSampler(m *model, options ...SampleOption) (*Sampler, error) {
+	op := &sampleParams{
+		logisBias:        map[binding.Token]float32{},
+		topK:             40,
+		topP:             0.95,
+		tfsZ:             1,
+		typicalP:         1,
+		temp:             0.8,
+		repeatPenalty:    1.1,
+		repeatLastN:      m.params.lastNTokensSize,
+		frequenctPenalty: 0,
+		presencePenalty:  0,
+		mirostat:         0,
+		mirostatTau:      5,
+		mirostatEta:      0.1,
+		dryBase:          1.75,
+		dryAllowedLength: 2,
+		dryPenaltyLastN:  m.params.lastNTokensSize,
+		xtcThreshold:     0.1,
+
+		drySequenceBreakers: defaultDrySequenceBreakers,
+	}
+	for _, apply := range options {
+		apply(op)
+	}
+
+	names := op.processors
+	if names == nil {
+		names = DefaultLogitsProcessors()
+	}
+	chain, err := lookupLogitsProcessors(names)
+	if err != nil {
+		return nil, err
+	}
+
+	vocabNum := int(m.ctx.VocabNum())
+	var guidance *model
+	if op.guidance != nil {
+		var ok bool
+		if guidance, ok = op.guidance.(*model); !ok {
+			return nil, fmt.Errorf("unsupported guidance context: %T", op.guidance)
+		}
+		if int(guidance.ctx.VocabNum()) != vocabNum {
+			return nil, fmt.Errorf("vocab of guidance context mismatch, %d != %d", guidance.ctx.VocabNum(), vocabNum)
+		}
+	}
+	return &Sampler{
+		m:          m,
+		params:     op,
+		mirostatMu: 2 * op.mirostatTau,
+		processors: chain,
+		logits:     make([]float32, vocabNum),
+		candidates: binding.NewTokenDataArray(uint32(vocabNum), false),
+		guidance:   guidance,
+	}, nil
+}
+
+// Sample samples next token from logits of last evaluated token
+func (s *Sampler) Sample() (binding.Token, error) {
+	return s.SampleBefore(0)
+}
+
+// SampleBefore samples the token following the one evaluated by last eval, which is followed by pendingNum
+// tokens. Pending tokens are ignored by penalties and processors, as if they were not evaluated. It lets tokens
+// evaluated in one batch be verified one by one, which requires logits all of model. An error is returned when
+// the sampled token is not accepted by grammar, which happens when grammar leaves no candidate.
+func (s *Sampler) SampleBefore(pendingNum int) (binding.Token, error) {
+	if rows := s.m.batchRows(); pendingNum >= rows {
+		pendingNum = rows - 1
+	}
+	s.pendingNum = pendingNum
+	defer func() { s.pendingNum = 0 }()
+
+	op := s.params
+	logits := s.m.batchLogits(s.logits, pendingNum)
+	if s.guidance != nil {
+		logits = s.guide(logits)
+	}
+
+	s.candidates.Reset(len(logits))
+	candidates := s.candidates.Data()
+	for i, logit := range logits {
+		candidates[i].SetID(int32(i))
+		candidates[i].SetLogit(logit)
+		candidates[i].SetP(0)
+	}
+	for token, bias := range op.logisBias {
+		if int(token) >= 0 && int(token) < len(candidates) {
+			candidates[token].SetLogit(candidates[token].Logit() + bias)
+		}
+	}
+
+	nl := binding.TokenNl()
+	nlLogit := candidates[nl].Logit()
+
+	if lastNTokens := s.lastNTokens(); len(lastNTokens) > 0 {
+		s.m.ctx.SampleRepetitionPenalty(s.candidates, lastNTokens, op.repeatPenalty)
+		s.m.ctx.SampleFrequencyAndPresencePenalties(s.candidates, lastNTokens, op.frequenctPenalty, op.presencePenalty)
+	}
+
+	if !op.penalizeNL {
+		// penalties keep the candidates in vocab order, so nl is still at its index
+		candidates[nl].SetLogit(nlLogit)
+	}
+
+	if op.grammar != nil {
+		op.grammar.Apply(candidates, s.m.Vocab())
+	}
+
+	token := s.sampleToken()
+
+	// eos is only sampled when grammar is done, it ends generation without text
+	if op.grammar != nil && token != binding.TokenEos() {
+		if err := op.grammar.Accept(s.m.Vocab()[token]); err != nil {
+			return token, fmt.Errorf("failed to accept token %d by grammar: %w", token, err)
+		}
+	}
+	return token, nil
+}
+
+// guide combines log probabilities of logits with those of guidance context in place
+func (s *Sampler) guide(logits []float32) []float32 {
+	if s.guidanceLogits == nil {
+		s.guidanceLogits = make([]float32, len(logits))
+	}
+	neg := s.guidance.batchLogits(s.guidanceLogits, 0)
+	posLSE, negLSE := LogSumExp(logits), LogSumExp(neg)
+	scale := s.params.cfgScale
+	for i := range logits {
+		negLogprob := neg[i] - negLSE
+		logits[i] = negLogprob + scale*(logits[i]-posLSE-negLogprob)
+	}
+	return logits
+}
+
+// Logits returns raw logits used by last Sample, which are guided when guidance is set. It is overwritten by
+// next Sample.
+func (s *Sampler) Logits() []float32 {
+	return s.logits
+}
+
+// Tokens returns all evaluated tokens of the generation, including prompt tokens
+func (s *Sampler) Tokens() []binding.Token {
+	return s.m.tokens[:len(s.m.tokens)-s.pendingNum]
+}
+
+// Vocab returns text of all tokens, indexed by token
+func (s *Sampler) Vocab() []string {
+	return s.m.Vocab()
+}
+
+// Close releases buffers of sampler
+func (s *Sampler) Close() error {
+	if s.candidates != nil {
+		s.candidates.Free()
+	}
+	s.candidates = nil
+	return nil
+}
+
+// lastNTokens returns the evaluated tokens penalized by repetition penalties, a negative repeatLastN means
+// the whole context
+func (s *Sampler) lastNTokens() []binding.Token {
+	n := s.params.repeatLastN
+	if n < 0 || n > s.m.ContextSize() {
+		n = s.m.ContextSize()
+	}
+	tokens := s.Tokens()
+	if n > len(tokens) {
+		n = len(tokens)
+	}
+	return tokens[len(tokens)-n:]
+}
+
+func (s *Sampler) sampleToken() binding.Token {
+	op := s.params
+	if op.greedy() {
+		return s.m.ctx.SampleTokenGreedy(s.candidates)
+	}
+
+	if op.mirostat == 1 {
+		s.m.ctx.SampleTemperature(s.candidates, op.temp)
+		return s.m.ctx.SampleTokenMirostat(s.candidates, op.mirostatTau, op.mirostatEta, mirostatM, &s.mirostatMu)
+	}
+
+	if op.mirostat == 2 {
+		s.m.ctx.SampleTemperature(s.candidates, op.temp)
+		return s.m.ctx.SampleTokenMirostatV2(s.candidates, op.mirostatTau, op.mirostatEta, &s.mirostatMu)
+	}
+
+	for _, processor := range s.processors {
+		processor.Process(s, s.candidates)
+	}
+	return s.m.ctx.SampleToken(s.candidates)
+}
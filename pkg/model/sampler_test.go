@@ -0,0 +1,22 @@
+package model
+
+import "testing"
+
+func TestSampleParamsGreedy(t *testing.T) {
+	cases := []struct {
+		temp   float32
+		greedy bool
+	}{
+		{temp: -1, greedy: true},
+		{temp: 0, greedy: true},
+		{temp: 0.01, greedy: false},
+		{temp: 0.8, greedy: false},
+	}
+	for _, c := range cases {
+		sp := &sampleParams{temp: 0.8}
+		WithTemp(c.temp)(sp)
+		if got := sp.greedy(); got != c.greedy {
+			t.Errorf("temp %v: expected greedy %v, got: %v", c.temp, c.greedy, got)
+		}
+	}
+}
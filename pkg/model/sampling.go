@@ -0,0 +1,136 @@
+package model
+
+import (
+	"math"
+	"strings"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+)
+
+// defaultDrySequenceBreakers stop matching of repeated sequences by dry
+var defaultDrySequenceBreakers = []string{"\n", ":", "\"", "*"}
+
+// sampleMinP removes candidates whose probability is less than min p times the probability of the most likely one
+func sampleMinP(s *Sampler, candidates *binding.TokenDataArray) {
+	if s.params.minP <= 0 || candidates.Size() == 0 {
+		return
+	}
+	s.m.ctx.SampleSoftmax(candidates)
+	data := candidates.Data()
+	threshold := data[0].P() * s.params.minP
+	keep := 1
+	for keep < len(data) && data[keep].P() >= threshold {
+		keep++
+	}
+	candidates.SetSize(keep)
+}
+
+// sampleTopA removes candidates whose probability is less than top a times the squared probability of the most
+// likely one
+func sampleTopA(s *Sampler, candidates *binding.TokenDataArray) {
+	if s.params.topA <= 0 || candidates.Size() == 0 {
+		return
+	}
+	s.m.ctx.SampleSoftmax(candidates)
+	data := candidates.Data()
+	threshold := s.params.topA * data[0].P() * data[0].P()
+	keep := 1
+	for keep < len(data) && data[keep].P() >= threshold {
+		keep++
+	}
+	candidates.SetSize(keep)
+}
+
+// sampleXTC removes all candidates above xtc threshold except the least likely of them, with xtc probability.
+// It excludes the most obvious choices while keeping a viable one.
+func sampleXTC(s *Sampler, candidates *binding.TokenDataArray) {
+	op := s.params
+	if op.xtcProbability <= 0 || candidates.Size() < 2 || s.m.rng.Float32() >= op.xtcProbability {
+		return
+	}
+	s.m.ctx.SampleSoftmax(candidates)
+	data := candidates.Data()
+	above := 0
+	for above < len(data) && data[above].P() >= op.xtcThreshold {
+		above++
+	}
+	if above < 2 {
+		return
+	}
+	removed := above - 1
+	copy(data, data[removed:])
+	candidates.SetSize(len(data) - removed)
+}
+
+// sampleDRY penalizes candidates which would extend a sequence repeated from the context. The penalty grows
+// exponentially with the length of the repeated sequence beyond dry allowed length.
+func sampleDRY(s *Sampler, candidates *binding.TokenDataArray) {
+	op := s.params
+	if op.dryMultiplier <= 0 {
+		return
+	}
+
+	tokens := s.Tokens()
+	n := op.dryPenaltyLastN
+	if n < 0 || n > s.m.ContextSize() {
+		n = s.m.ContextSize()
+	}
+	if n < len(tokens) {
+		tokens = tokens[len(tokens)-n:]
+	}
+	if len(tokens) < 2 {
+		return
+	}
+
+	breakers := s.drySequenceBreakers()
+	last := len(tokens) - 1
+	if breakers[tokens[last]] {
+		return
+	}
+
+	// matchLens is the length of the longest repeated sequence followed by token
+	matchLens := map[binding.Token]int{}
+	for i := 0; i < last; i++ {
+		matchLen := 0
+		for matchLen <= i && tokens[i-matchLen] == tokens[last-matchLen] && !breakers[tokens[i-matchLen]] {
+			matchLen++
+		}
+		if matchLen < op.dryAllowedLength {
+			continue
+		}
+		if next := tokens[i+1]; matchLen > matchLens[next] {
+			matchLens[next] = matchLen
+		}
+	}
+	if len(matchLens) == 0 {
+		return
+	}
+
+	data := candidates.Data()
+	for i := range data {
+		matchLen, ok := matchLens[binding.Token(data[i].ID())]
+		if !ok {
+			continue
+		}
+		penalty := op.dryMultiplier * float32(math.Pow(float64(op.dryBase), float64(matchLen-op.dryAllowedLength)))
+		data[i].SetLogit(data[i].Logit() - penalty)
+	}
+	candidates.SetSorted(false)
+}
+
+// drySequenceBreakers returns tokens whose text contains any dry sequence breaker, loaded on first use
+func (s *Sampler) drySequenceBreakers() map[binding.Token]bool {
+	if s.dryBreakers != nil {
+		return s.dryBreakers
+	}
+	s.dryBreakers = map[binding.Token]bool{}
+	for token, text := range s.m.Vocab() {
+		for _, breaker := range s.params.drySequenceBreakers {
+			if breaker != "" && strings.Contains(text, breaker) {
+				s.dryBreakers[binding.Token(token)] = true
+				break
+			}
+		}
+	}
+	return s.dryBreakers
+}
@@ -0,0 +1,371 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// JSONObjectSchema accepts any json object
+const JSONObjectSchema = `{"type": "object"}`
+
+var jsonPrimitiveRules = map[string]string{
+	"space":   `" "?`,
+	"boolean": `("true" | "false") space`,
+	"number":  `"-"? ([0-9] | [1-9] [0-9]*) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space`,
+	"integer": `"-"? ([0-9] | [1-9] [0-9]*) space`,
+	"string":  `"\"" ( [^"\\\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]) )* "\"" space`,
+	"null":    `"null" space`,
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+	"array":   `"[" space ( value ("," space value)* )? "]" space`,
+}
+
+// jsonPrimitiveDeps is the rules used by each primitive rule
+var jsonPrimitiveDeps = map[string][]string{
+	"boolean": {"space"},
+	"number":  {"space"},
+	"integer": {"space"},
+	"string":  {"space"},
+	"null":    {"space"},
+	"value":   {"object", "array", "string", "number", "boolean", "null"},
+	"object":  {"space", "string", "value"},
+	"array":   {"space", "value"},
+}
+
+var invalidRuleNameChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+type jsonSchema struct {
+	Type        any                        `json:"type"`
+	Properties  json.RawMessage            `json:"properties"`
+	Required    []string                   `json:"required"`
+	Items       json.RawMessage            `json:"items"`
+	MinItems    int                        `json:"minItems"`
+	Enum        []any                      `json:"enum"`
+	Const       json.RawMessage            `json:"const"`
+	OneOf       []json.RawMessage          `json:"oneOf"`
+	AnyOf       []json.RawMessage          `json:"anyOf"`
+	Ref         string                     `json:"$ref"`
+	Defs        map[string]json.RawMessage `json:"$defs"`
+	Definitions map[string]json.RawMessage `json:"definitions"`
+}
+
+type jsonSchemaConverter struct {
+	rules map[string]string
+	refs  map[string]string
+	defs  map[string]json.RawMessage
+}
+
+// JSONSchemaGrammar converts a json schema into GBNF grammar text, which accepts json documents valid under the schema.
+// Supported keywords are type, properties, required, items, minItems, enum, const, oneOf, anyOf and local $ref. A
+// missing type is implied by properties, required and items.
+func JSONSchemaGrammar(schema []byte) (string, error) {
+	root := &jsonSchema{}
+	if err := json.Unmarshal(schema, root); err != nil {
+		return "", fmt.Errorf("invalid json schema: %v", err)
+	}
+
+	c := &jsonSchemaConverter{rules: map[string]string{}, refs: map[string]string{}, defs: map[string]json.RawMessage{}}
+	for name, def := range root.Definitions {
+		c.defs["#/definitions/"+name] = def
+	}
+	for name, def := range root.Defs {
+		c.defs["#/$defs/"+name] = def
+	}
+
+	rule, err := c.visit(schema, "root")
+	if err != nil {
+		return "", err
+	}
+	if rule != "root" {
+		c.rules["root"] = rule
+	}
+
+	names := make([]string, 0, len(c.rules))
+	for name := range c.rules {
+		if name != "root" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("root ::= %s\n", c.rules["root"]))
+	for _, name := range names {
+		builder.WriteString(fmt.Sprintf("%s ::= %s\n", name, c.rules[name]))
+	}
+	return builder.String(), nil
+}
+
+func (c *jsonSchemaConverter) addRule(name, rule string) string {
+	name = invalidRuleNameChars.ReplaceAllString(name, "-")
+	key := name
+	for i := 0; ; i++ {
+		if existing, ok := c.rules[key]; !ok || existing == rule {
+			break
+		}
+		key = fmt.Sprintf("%s%d", name, i)
+	}
+	c.rules[key] = rule
+	return key
+}
+
+// reserveRule returns an unused rule name, which is defined later
+func (c *jsonSchemaConverter) reserveRule(name string) string {
+	name = invalidRuleNameChars.ReplaceAllString(name, "-")
+	key := name
+	for i := 0; ; i++ {
+		if _, ok := c.rules[key]; !ok {
+			break
+		}
+		key = fmt.Sprintf("%s%d", name, i)
+	}
+	c.rules[key] = ""
+	return key
+}
+
+func (c *jsonSchemaConverter) addPrimitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		c.rules[name] = jsonPrimitiveRules[name]
+		for _, dep := range jsonPrimitiveDeps[name] {
+			c.addPrimitive(dep)
+		}
+	}
+	return name
+}
+
+func (c *jsonSchemaConverter) visit(raw json.RawMessage, name string) (string, error) {
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(raw, schema); err != nil {
+		return "", fmt.Errorf("invalid json schema: %s, err: %v", string(raw), err)
+	}
+
+	switch {
+	case schema.Ref != "":
+		return c.visitRef(schema.Ref)
+	case len(schema.OneOf) > 0 || len(schema.AnyOf) > 0:
+		alts := make([]string, 0)
+		for i, sub := range append(schema.OneOf, schema.AnyOf...) {
+			rule, err := c.visit(sub, fmt.Sprintf("%s-%d", name, i))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, rule)
+		}
+		return c.addRule(name, strings.Join(alts, " | ")), nil
+	case len(schema.Const) > 0:
+		c.addPrimitive("space")
+		return c.addRule(name, jsonLiteral(schema.Const)+" space"), nil
+	case len(schema.Enum) > 0:
+		c.addPrimitive("space")
+		alts := make([]string, 0, len(schema.Enum))
+		for _, v := range schema.Enum {
+			data, err := marshalJSON(v)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, jsonLiteral(data))
+		}
+		return c.addRule(name, "("+strings.Join(alts, " | ")+") space"), nil
+	}
+
+	switch typ := schema.Type.(type) {
+	case []any:
+		alts := make([]string, 0, len(typ))
+		for _, t := range typ {
+			s, ok := t.(string)
+			if !ok {
+				return "", fmt.Errorf("invalid json schema type: %v", t)
+			}
+			rule, err := c.visitType(s, schema, fmt.Sprintf("%s-%s", name, s))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, rule)
+		}
+		return c.addRule(name, strings.Join(alts, " | ")), nil
+	case string:
+		return c.visitType(typ, schema, name)
+	case nil:
+		// hand written schemas often leave out the type implied by their keywords
+		if len(schema.Properties) > 0 || len(schema.Required) > 0 {
+			return c.visitType("object", schema, name)
+		}
+		if len(schema.Items) > 0 {
+			return c.visitType("array", schema, name)
+		}
+		return c.addPrimitive("value"), nil
+	default:
+		return "", fmt.Errorf("invalid json schema type: %v", typ)
+	}
+}
+
+func (c *jsonSchemaConverter) visitRef(ref string) (string, error) {
+	if rule, ok := c.refs[ref]; ok {
+		return rule, nil
+	}
+	def, ok := c.defs[ref]
+	if !ok {
+		return "", fmt.Errorf("unresolved json schema ref: %s", ref)
+	}
+	// reserve the rule name of the full ref path before visiting, so that recursive refs resolve to it
+	placeholder := c.reserveRule("ref-" + strings.TrimPrefix(ref, "#/"))
+	c.refs[ref] = placeholder
+
+	rule, err := c.visit(def, placeholder+"-def")
+	if err != nil {
+		return "", err
+	}
+	c.rules[placeholder] = rule
+	return placeholder, nil
+}
+
+func (c *jsonSchemaConverter) visitType(typ string, schema *jsonSchema, name string) (string, error) {
+	switch typ {
+	case "object":
+		if emptyProperties(schema.Properties) {
+			return c.addPrimitive("object"), nil
+		}
+		return c.visitObject(schema, name)
+	case "array":
+		c.addPrimitive("space")
+		item := "value"
+		if len(schema.Items) > 0 {
+			var err error
+			item, err = c.visit(schema.Items, name+"-item")
+			if err != nil {
+				return "", err
+			}
+		} else {
+			c.addPrimitive(item)
+		}
+		items := fmt.Sprintf(`%s ("," space %s)*`, item, item)
+		if schema.MinItems == 0 {
+			items = "(" + items + ")?"
+		}
+		return c.addRule(name, fmt.Sprintf(`"[" space %s "]" space`, items)), nil
+	case "string", "number", "integer", "boolean", "null":
+		return c.addPrimitive(typ), nil
+	}
+	return "", fmt.Errorf("unsupported json schema type: %s", typ)
+}
+
+// emptyProperties returns if properties declares no property, so that any object is accepted. Invalid properties
+// are left to visitObject to report.
+func emptyProperties(raw json.RawMessage) bool {
+	if len(raw) == 0 {
+		return true
+	}
+	properties := map[string]json.RawMessage{}
+	return json.Unmarshal(raw, &properties) == nil && len(properties) == 0
+}
+
+func (c *jsonSchemaConverter) visitObject(schema *jsonSchema, name string) (string, error) {
+	c.addPrimitive("space")
+
+	keys, err := orderedKeys(schema.Properties)
+	if err != nil {
+		return "", err
+	}
+	properties := map[string]json.RawMessage{}
+	if err := json.Unmarshal(schema.Properties, &properties); err != nil {
+		return "", err
+	}
+
+	requiredSet := map[string]bool{}
+	for _, key := range schema.Required {
+		requiredSet[key] = true
+	}
+
+	required := make([]string, 0)
+	optional := make([]string, 0)
+	for _, key := range keys {
+		keyName, err := marshalJSON(key)
+		if err != nil {
+			return "", err
+		}
+		value, err := c.visit(properties[key], name+"-"+key)
+		if err != nil {
+			return "", err
+		}
+		kv := c.addRule(name+"-"+key+"-kv", fmt.Sprintf(`%s space ":" space %s`, jsonLiteral(keyName), value))
+		if requiredSet[key] {
+			required = append(required, kv)
+		} else {
+			optional = append(optional, kv)
+		}
+	}
+
+	parts := []string{`"{" space`}
+	if len(required) > 0 {
+		parts = append(parts, strings.Join(required, ` "," space `))
+	}
+	if len(optional) > 0 {
+		// rest-i accepts any ordered subset of optional properties from i
+		rest := ""
+		for i := len(optional) - 1; i >= 0; i-- {
+			alt := optional[i]
+			if rest != "" {
+				alt = fmt.Sprintf(`%s ("," space %s)? | %s`, optional[i], rest, rest)
+			}
+			rest = c.addRule(fmt.Sprintf("%s-rest-%d", name, i), alt)
+		}
+		if len(required) > 0 {
+			parts = append(parts, fmt.Sprintf(`("," space %s)?`, rest))
+		} else {
+			parts = append(parts, fmt.Sprintf(`(%s)?`, rest))
+		}
+	}
+	parts = append(parts, `"}" space`)
+	return c.addRule(name, strings.Join(parts, " ")), nil
+}
+
+// orderedKeys returns keys of json object in the order they are defined
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid json object key: %v", token)
+		}
+		keys = append(keys, key)
+
+		value := json.RawMessage{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// marshalJSON encodes v without escaping html characters, as models generate them literally
+func marshalJSON(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// jsonLiteral returns a GBNF literal matching the compact json text of value
+func jsonLiteral(value json.RawMessage) string {
+	compacted := &bytes.Buffer{}
+	if err := json.Compact(compacted, value); err != nil {
+		compacted = bytes.NewBuffer(value)
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(compacted.String()) + `"`
+}
@@ -0,0 +1,170 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONSchemaGrammar(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		accepted []string
+		rejected []string
+	}{
+		{
+			name:     "any object",
+			schema:   JSONObjectSchema,
+			accepted: []string{`{}`, `{"a": 1}`, `{"a": [true, null, "x"]}`},
+			rejected: []string{`[]`, `"a"`, `{"a"}`},
+		},
+		{
+			name:     "primitives",
+			schema:   `{"type": "array", "items": {"type": ["integer", "boolean", "null"]}}`,
+			accepted: []string{`[]`, `[1, -2, true, null]`},
+			rejected: []string{`[1.5]`, `["1"]`, `[01]`},
+		},
+		{
+			name:     "number",
+			schema:   `{"type": "number"}`,
+			accepted: []string{`0`, `-1.5`, `2e10`, `3.25E-2`},
+			rejected: []string{`.5`, `1.`, `+1`},
+		},
+		{
+			name:     "string escapes",
+			schema:   `{"type": "string"}`,
+			accepted: []string{`""`, `"a b"`, `"\"\\\n"`, `"é"`},
+			rejected: []string{`"a`, `"\x"`, "\"\n\""},
+		},
+		{
+			name: "required and optional properties",
+			schema: `{
+				"type": "object",
+				"properties": {"name": {"type": "string"}, "age": {"type": "integer"}, "tag": {"type": "string"}},
+				"required": ["name"]
+			}`,
+			accepted: []string{`{"name": "a"}`, `{"name": "a", "age": 1}`, `{"name": "a", "tag": "b"}`, `{"name": "a", "age": 1, "tag": "b"}`},
+			rejected: []string{`{}`, `{"age": 1}`, `{"name": "a", "tag": "b", "age": 1}`, `{"name": 1}`},
+		},
+		{
+			name:     "only optional properties",
+			schema:   `{"type": "object", "properties": {"a": {"type": "integer"}, "b": {"type": "integer"}}}`,
+			accepted: []string{`{}`, `{"a": 1}`, `{"b": 2}`, `{"a": 1, "b": 2}`},
+			rejected: []string{`{"b": 2, "a": 1}`, `{"c": 1}`},
+		},
+		{
+			name:     "min items",
+			schema:   `{"type": "array", "items": {"type": "string"}, "minItems": 1}`,
+			accepted: []string{`["a"]`, `["a", "b"]`},
+			rejected: []string{`[]`, `[1]`},
+		},
+		{
+			name:     "enum and const",
+			schema:   `{"type": "object", "properties": {"kind": {"enum": ["a", 1, null]}, "v": {"const": {"x": "<y>"}}}, "required": ["kind", "v"]}`,
+			accepted: []string{`{"kind": "a", "v": {"x":"<y>"}}`, `{"kind": 1, "v": {"x":"<y>"}}`, `{"kind": null, "v": {"x":"<y>"}}`},
+			rejected: []string{`{"kind": "b", "v": {"x":"<y>"}}`, `{"kind": "a", "v": {"x":"y"}}`},
+		},
+		{
+			name:     "one of",
+			schema:   `{"oneOf": [{"type": "string"}, {"type": "array", "items": {"type": "integer"}}]}`,
+			accepted: []string{`"a"`, `[1, 2]`},
+			rejected: []string{`1`, `["a"]`},
+		},
+		{
+			name: "recursive ref",
+			schema: `{
+				"$ref": "#/$defs/node",
+				"$defs": {"node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/$defs/node"}}}}}
+			}`,
+			accepted: []string{`{}`, `{"children": []}`, `{"children": [{"children": [{}]}]}`},
+			rejected: []string{`{"children": [1]}`},
+		},
+		{
+			name: "refs of the same name",
+			schema: `{
+				"$ref": "#/definitions/item",
+				"definitions": {"item": {"type": "array", "items": {"$ref": "#/$defs/item"}}},
+				"$defs": {"item": {"type": "integer"}}
+			}`,
+			accepted: []string{`[]`, `[1, 2]`},
+			rejected: []string{`[[1]]`, `[[]]`, `["a"]`},
+		},
+		{
+			name:     "properties without type",
+			schema:   `{"properties": {"name": {"type": "string"}}, "required": ["name"]}`,
+			accepted: []string{`{"name": "a"}`},
+			rejected: []string{`{}`, `{"name": 1}`, `"a"`, `[]`},
+		},
+		{
+			name:     "required without type",
+			schema:   `{"required": ["name"]}`,
+			accepted: []string{`{}`, `{"name": 1}`},
+			rejected: []string{`"a"`, `[]`},
+		},
+		{
+			name:     "items without type",
+			schema:   `{"items": {"type": "integer"}}`,
+			accepted: []string{`[]`, `[1, 2]`},
+			rejected: []string{`["a"]`, `{}`, `1`},
+		},
+		{
+			name:     "empty properties",
+			schema:   `{"type": "object", "properties": {}}`,
+			accepted: []string{`{}`, `{"a": 1}`, `{"a": {"b": [null]}}`},
+			rejected: []string{`[]`, `"a"`},
+		},
+		{
+			name:     "null properties",
+			schema:   `{"type": "object", "properties": null}`,
+			accepted: []string{`{}`, `{"a": 1}`},
+			rejected: []string{`[]`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := JSONSchemaGrammar([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("failed to convert schema, err: %v", err)
+			}
+			g, err := ParseGrammar(text)
+			if err != nil {
+				t.Fatalf("failed to parse grammar, err: %v, grammar:\n%s", err, text)
+			}
+			for _, doc := range tt.accepted {
+				if !accepts(g, doc) {
+					t.Errorf("expected %s to be accepted, grammar:\n%s", doc, text)
+				}
+			}
+			for _, doc := range tt.rejected {
+				if accepts(g, doc) {
+					t.Errorf("expected %s to be rejected, grammar:\n%s", doc, text)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONSchemaGrammarErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{name: "invalid json", schema: `{"type": `, err: "invalid json schema"},
+		{name: "unresolved ref", schema: `{"$ref": "#/$defs/missing"}`, err: "unresolved json schema ref"},
+		{name: "remote ref", schema: `{"$ref": "https://example.com/schema.json"}`, err: "unresolved json schema ref"},
+		{name: "unsupported type", schema: `{"type": "date"}`, err: "unsupported json schema type"},
+		{name: "invalid type", schema: `{"type": 1}`, err: "invalid json schema type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := JSONSchemaGrammar([]byte(tt.schema))
+			if err == nil {
+				t.Fatalf("expected error containing %q", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got: %v", tt.err, err)
+			}
+		})
+	}
+}
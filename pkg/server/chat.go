@@ -2,7 +2,7 @@ package server
 
 import (
 	"context"
-	"io"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -10,13 +10,14 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
 	"github.com/bdqfork/go-llama.cpp/pkg/llm"
 	"github.com/bdqfork/go-llama.cpp/pkg/model"
 	"github.com/bdqfork/go-llama.cpp/pkg/util"
 )
 
 func (s *Server) chatCompletion(ctx *gin.Context) {
-	req := &ChatCompletionRequest{MaxTokens: 16, Temperature: 1, TopP: 1, N: 1}
+	req := &ChatCompletionRequest{MaxTokens: 16, N: 1}
 	if err := ctx.ShouldBind(req); err != nil {
 		klog.Errorf("failed to bind completion request, err: %v", err)
 		ctx.JSON(http.StatusInternalServerError, err.Error())
@@ -35,6 +36,27 @@ func (s *Server) chatCompletion(ctx *gin.Context) {
 		return
 	}
 
+	if req.TopLogprobs < 0 || req.TopLogprobs > maxTopLogprobs {
+		ctx.JSON(http.StatusBadRequest, errInvalidLogprobs.Error())
+		return
+	}
+
+	if err := req.SamplingRequest.validate(s.ctx.Config.ModelConfigs[req.Model].Sampling); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := req.BeamSearchRequest.validate(req.N, req.Stream, req.Grammar != "" || req.ResponseFormat != nil); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sessionID, err := chatSessionID(ctx, req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	l, err := s.ctx.LLM(req.Model)
 	if err != nil {
 		klog.Errorf("failed to load model, err: %v", err)
@@ -43,9 +65,6 @@ func (s *Server) chatCompletion(ctx *gin.Context) {
 	}
 
 	options := make([]model.SampleOption, 0)
-	options = append(options, model.WithTopP(req.TopP), model.WithTemp(req.Temperature),
-		model.WithFrequenctPenalty(req.FrequencyPenalty), model.WithPresencePenalty(req.PresencePenalty))
-
 	if req.LogitBias != nil {
 		logitBias := map[binding.Token]float32{}
 		for k, v := range req.LogitBias {
@@ -55,13 +74,76 @@ func (s *Server) chatCompletion(ctx *gin.Context) {
 		options = append(options, model.WithLogisBiasK(logitBias))
 	}
 
+	modelConfig := s.ctx.Config.ModelConfigs[req.Model]
+	if err := req.GuidanceRequest.validate(modelConfig.Guidance, req.NumBeams); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	llmOptions := []llm.Option{llm.WithN(req.N), llm.WithSampleOptions(options...)}
+	llmOptions = append(llmOptions, samplingOptions(req.SamplingRequest, modelConfig.Sampling)...)
+	llmOptions = append(llmOptions, contextShiftOptions(req.ContextShiftRequest, modelConfig.ContextShift)...)
+	llmOptions = append(llmOptions, beamSearchOptions(req.BeamSearchRequest)...)
+	llmOptions = append(llmOptions, guidanceOptions(req.GuidanceRequest)...)
+	if len(req.StopTokenIDs) > 0 {
+		llmOptions = append(llmOptions, llm.WithStopTokens(stopTokens(req.StopTokenIDs)))
+	}
+	llmOptions = append(llmOptions, s.scheduleOptions(ctx, req.User, req.Priority, chatPriority)...)
+	if req.Grammar != "" {
+		grammar, err := model.ParseGrammar(req.Grammar)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		llmOptions = append(llmOptions, llm.WithGrammar(grammar))
+	}
+	if req.ResponseFormat != nil {
+		if req.Grammar != "" {
+			ctx.JSON(http.StatusBadRequest, errGrammarConflict.Error())
+			return
+		}
+		grammar, err := responseFormatGrammar(req.ResponseFormat)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		if grammar != nil {
+			llmOptions = append(llmOptions, llm.WithGrammar(grammar))
+		}
+	}
+	if req.Logprobs {
+		llmOptions = append(llmOptions, llm.WithLogprobs(req.TopLogprobs))
+	}
+	truncation, err := truncationOption(req.TruncationStrategy, modelConfig.Truncation)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	llmOptions = append(llmOptions, truncation)
+	if len(req.Tools) > 0 {
+		toolChoice, err := parseToolChoice(req.ToolChoice)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		forced := toolChoice.Type == llm.ToolChoiceRequired || toolChoice.Type == llm.ToolChoiceFunction
+		if forced && (req.Grammar != "" || req.ResponseFormat != nil) {
+			ctx.JSON(http.StatusBadRequest, errToolConflict.Error())
+			return
+		}
+		if forced && req.NumBeams > 1 {
+			ctx.JSON(http.StatusBadRequest, errBeamSearchGrammar.Error())
+			return
+		}
+		llmOptions = append(llmOptions, llm.WithTools(req.Tools, toolChoice))
+	}
+
 	completionContext, cancel := context.WithCancel(context.Background())
 	go func() {
 		<-ctx.Writer.CloseNotify()
 		cancel()
 	}()
 
-	modelConfig := s.ctx.Config.ModelConfigs[req.Model]
 	input := make([]llm.ChatCompletionMessage, 0)
 	for _, message := range req.Messages {
 		role := message.Role
@@ -69,16 +151,25 @@ func (s *Server) chatCompletion(ctx *gin.Context) {
 			role = val
 		}
 		input = append(input, llm.ChatCompletionMessage{
-			Role:    role,
-			Content: message.Content,
-			User:    message.User,
+			Role:       role,
+			Content:    message.Content,
+			Name:       message.Name,
+			ToolCalls:  message.ToolCalls,
+			ToolCallID: message.ToolCallID,
+			User:       message.User,
 		})
 	}
 
 	if !req.Stream {
-		completion, err := l.ChatCompletion(completionContext, req.User, input, stops, req.MaxTokens, options...)
+		completion, err := l.ChatCompletion(completionContext, sessionID, input, stops, req.MaxTokens, llmOptions...)
+		if req.EndSession {
+			endSession(l, sessionID)
+		}
 		if err != nil {
 			klog.Errorf("failed to chat completion: %v", err)
+			if s.rejected(ctx, req.Model, err) {
+				return
+			}
 			ctx.JSON(http.StatusInternalServerError, errProcessingFailed)
 			return
 		}
@@ -87,22 +178,86 @@ func (s *Server) chatCompletion(ctx *gin.Context) {
 	}
 
 	chunkChan := make(chan *llm.ChatCompletionChunk)
+	positionChan := make(chan int, 1)
+	errChan := make(chan error, 1)
+	if req.StreamOptions != nil && req.StreamOptions.IncludeQueuePosition {
+		llmOptions = append(llmOptions, llm.WithQueueListener(queueListener(positionChan)))
+	}
 
 	go func() {
-		err = l.ChatCompletionStream(completionContext, req.User, input, req.MaxTokens, stops, chunkChan, options...)
-		if err != nil {
-			klog.Errorf("failed to chat completion stream: %v", err)
-			ctx.JSON(http.StatusInternalServerError, errInternalAppError)
+		err := l.ChatCompletionStream(completionContext, sessionID, input, req.MaxTokens, stops, chunkChan, llmOptions...)
+		if req.EndSession {
+			endSession(l, sessionID)
 		}
+		errChan <- err
 	}()
 
-	ctx.Stream(func(w io.Writer) bool {
-		chunk, ok := <-chunkChan
-		if !ok {
-			ctx.SSEvent("message", "[DONE]")
-			return false
+	stream(s, ctx, req.Model, chunkChan, positionChan, errChan)
+}
+
+// truncationOption returns truncation of chat history, fields of request override model config
+func truncationOption(req *TruncationStrategy, defaults config.TruncationConfig) (llm.Option, error) {
+	name := defaults.Strategy
+	lastMessages := defaults.LastMessages
+	if req != nil {
+		if req.Type != "" {
+			name = req.Type
+		}
+		if req.LastMessages != nil {
+			if *req.LastMessages < 1 {
+				return nil, errInvalidLastMessages
+			}
+			lastMessages = *req.LastMessages
 		}
-		ctx.SSEvent("message", chunk)
-		return true
-	})
+	}
+	strategy, err := llm.ParseTruncationStrategy(name)
+	if err != nil {
+		return nil, err
+	}
+	return llm.WithTruncation(strategy, lastMessages), nil
+}
+
+// responseFormatGrammar returns grammar restricts output to response format, nil for text format
+func responseFormatGrammar(format *ResponseFormat) (*model.Grammar, error) {
+	var schema []byte
+	switch format.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		schema = []byte(model.JSONObjectSchema)
+	case "json_schema":
+		if format.JSONSchema == nil || len(format.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("json_schema is required for response format json_schema")
+		}
+		schema = format.JSONSchema.Schema
+	default:
+		return nil, fmt.Errorf("unsupported response format: %s", format.Type)
+	}
+
+	text, err := model.JSONSchemaGrammar(schema)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("response format grammar: %s", text)
+	return model.ParseGrammar(text)
+}
+
+// parseToolChoice parses tool_choice, which is none, auto, required, or a named function object
+func parseToolChoice(toolChoice any) (llm.ToolChoice, error) {
+	switch v := toolChoice.(type) {
+	case nil:
+		return llm.ToolChoice{Type: llm.ToolChoiceAuto}, nil
+	case string:
+		switch v {
+		case llm.ToolChoiceNone, llm.ToolChoiceAuto, llm.ToolChoiceRequired:
+			return llm.ToolChoice{Type: v}, nil
+		}
+	case map[string]any:
+		function, _ := v["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		if v["type"] == llm.ToolChoiceFunction && name != "" {
+			return llm.ToolChoice{Type: llm.ToolChoiceFunction, Function: name}, nil
+		}
+	}
+	return llm.ToolChoice{}, fmt.Errorf("invalid tool_choice: %v", toolChoice)
 }
@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"io"
 	"net/http"
 	"time"
 
@@ -16,7 +15,7 @@ import (
 )
 
 func (s *Server) completion(ctx *gin.Context) {
-	req := &CompletionRequest{MaxTokens: 16, Temperature: 1, TopP: 1, N: 1}
+	req := &CompletionRequest{MaxTokens: 16, N: 1}
 	if err := ctx.ShouldBind(req); err != nil {
 		klog.Errorf("failed to bind completion request, err: %v", err)
 		ctx.JSON(http.StatusInternalServerError, err.Error())
@@ -41,6 +40,31 @@ func (s *Server) completion(ctx *gin.Context) {
 		return
 	}
 
+	if req.BestOf != 0 && req.BestOf < req.N {
+		ctx.JSON(http.StatusBadRequest, errInvalidBestOf.Error())
+		return
+	}
+
+	if req.Logprobs != nil && (*req.Logprobs < 0 || *req.Logprobs > maxTopLogprobs) {
+		ctx.JSON(http.StatusBadRequest, errInvalidLogprobs.Error())
+		return
+	}
+
+	if req.Stream && req.BestOf > req.N {
+		ctx.JSON(http.StatusBadRequest, errStreamBestOf.Error())
+		return
+	}
+
+	if err := req.SamplingRequest.validate(s.ctx.Config.ModelConfigs[req.Model].Sampling); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := req.BeamSearchRequest.validate(req.N, req.Stream, req.Grammar != ""); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	l, err := s.ctx.LLM(req.Model)
 	if err != nil {
 		klog.Errorf("failed to load model, err: %v", err)
@@ -49,9 +73,6 @@ func (s *Server) completion(ctx *gin.Context) {
 	}
 
 	options := make([]model.SampleOption, 0)
-	options = append(options, model.WithTopP(req.TopP), model.WithTemp(req.Temperature),
-		model.WithFrequenctPenalty(req.FrequencyPenalty), model.WithPresencePenalty(req.PresencePenalty))
-
 	if req.LogitBias != nil {
 		logitBias := map[binding.Token]float32{}
 		for k, v := range req.LogitBias {
@@ -61,18 +82,50 @@ func (s *Server) completion(ctx *gin.Context) {
 		options = append(options, model.WithLogisBiasK(logitBias))
 	}
 
+	modelConfig := s.ctx.Config.ModelConfigs[req.Model]
+	if err := req.GuidanceRequest.validate(modelConfig.Guidance, req.NumBeams); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	llmOptions := []llm.Option{llm.WithN(req.N), llm.WithBestOf(req.BestOf), llm.WithSampleOptions(options...)}
+	llmOptions = append(llmOptions, samplingOptions(req.SamplingRequest, modelConfig.Sampling)...)
+	llmOptions = append(llmOptions, contextShiftOptions(req.ContextShiftRequest, modelConfig.ContextShift)...)
+	llmOptions = append(llmOptions, beamSearchOptions(req.BeamSearchRequest)...)
+	llmOptions = append(llmOptions, guidanceOptions(req.GuidanceRequest)...)
+	if len(req.StopTokenIDs) > 0 {
+		llmOptions = append(llmOptions, llm.WithStopTokens(stopTokens(req.StopTokenIDs)))
+	}
+	llmOptions = append(llmOptions, s.scheduleOptions(ctx, req.User, req.Priority, completionPriority)...)
+	if req.Grammar != "" {
+		grammar, err := model.ParseGrammar(req.Grammar)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		llmOptions = append(llmOptions, llm.WithGrammar(grammar))
+	}
+	if req.Logprobs != nil {
+		llmOptions = append(llmOptions, llm.WithLogprobs(*req.Logprobs))
+	}
+
 	llmContext, cancel := context.WithCancel(context.Background())
 	go func() {
 		<-ctx.Writer.CloseNotify()
 		cancel()
 	}()
 
-	prompt := prompts[0]
+	if len(prompts) == 0 {
+		prompts = []string{""}
+	}
 
 	if !req.Stream {
-		completion, err := l.Completion(llmContext, prompt, stops, req.Suffix, req.MaxTokens, req.Echo, options...)
+		completion, err := l.Completion(llmContext, prompts, stops, req.Suffix, req.MaxTokens, req.Echo, llmOptions...)
 		if err != nil {
 			klog.Errorf("failed to completion: %v", err)
+			if s.rejected(ctx, req.Model, err) {
+				return
+			}
 			ctx.JSON(http.StatusInternalServerError, errProcessingFailed)
 			return
 		}
@@ -81,22 +134,24 @@ func (s *Server) completion(ctx *gin.Context) {
 	}
 
 	chunkChan := make(chan *llm.CompletionChunk)
+	positionChan := make(chan int, 1)
+	errChan := make(chan error, 1)
+	if req.StreamOptions != nil && req.StreamOptions.IncludeQueuePosition {
+		llmOptions = append(llmOptions, llm.WithQueueListener(queueListener(positionChan)))
+	}
 
 	go func() {
-		err = l.CompletionStream(llmContext, prompt, stops, req.MaxTokens, chunkChan, options...)
-		if err != nil {
-			klog.Errorf("failed to completion stream: %v", err)
-			ctx.JSON(http.StatusInternalServerError, errInternalAppError)
-		}
+		errChan <- l.CompletionStream(llmContext, prompts, stops, req.MaxTokens, chunkChan, llmOptions...)
 	}()
 
-	ctx.Stream(func(w io.Writer) bool {
-		chunk, ok := <-chunkChan
-		if !ok {
-			ctx.SSEvent("message", "[DONE]")
-			return false
-		}
-		ctx.SSEvent("message", chunk)
-		return true
-	})
+	stream(s, ctx, req.Model, chunkChan, positionChan, errChan)
+}
+
+// stopTokens converts stop token ids of request to tokens
+func stopTokens(ids []int) []binding.Token {
+	tokens := make([]binding.Token, 0, len(ids))
+	for _, id := range ids {
+		tokens = append(tokens, binding.Token(id))
+	}
+	return tokens
 }
@@ -47,6 +47,9 @@ func (s *Server) embedding(ctx *gin.Context) {
 	embedding, err := l.GetEmbedding(llmContext, inputs)
 	if err != nil {
 		klog.Errorf("failed to get embedding, err: %v", err)
+		if s.rejected(ctx, req.Model, err) {
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, errProcessingFailed)
 		return
 	}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/llm"
+)
+
+const defaultRetryAfter = time.Second
+
+// rejected responds request rejected by queue of model with retry after header, returns false if err is not
+// caused by queue
+func (s *Server) rejected(ctx *gin.Context, modelName string, err error) bool {
+	var status int
+	switch {
+	case errors.Is(err, llm.ErrQueueFull):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, llm.ErrQueueTimeout):
+		status = http.StatusServiceUnavailable
+	default:
+		return false
+	}
+
+	retryAfter := s.ctx.Config.ModelConfigs[modelName].Queue.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	ctx.JSON(status, err.Error())
+	return true
+}
+
+// queueListener returns a listener which sends queue positions into channel, stale positions are dropped
+func queueListener(positionChan chan int) func(position int) {
+	return func(position int) {
+		for {
+			select {
+			case positionChan <- position:
+				return
+			default:
+			}
+			select {
+			case <-positionChan:
+			default:
+			}
+		}
+	}
+}
+
+// stream sends chunks as server sent events until chunkChan is closed, then reads the result from errChan.
+// Queue positions are sent as queue events. An error before any event is responded with its status.
+func stream[T any](s *Server, ctx *gin.Context, modelName string, chunkChan <-chan T, positionChan <-chan int, errChan <-chan error) {
+	started := false
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case position := <-positionChan:
+			started = true
+			ctx.SSEvent("queue", gin.H{"position": position})
+			return true
+		case chunk, ok := <-chunkChan:
+			if ok {
+				started = true
+				ctx.SSEvent("message", chunk)
+				return true
+			}
+		}
+
+		if err := <-errChan; err != nil {
+			klog.Errorf("failed to stream, err: %v", err)
+			if !started {
+				if !s.rejected(ctx, modelName, err) {
+					ctx.JSON(http.StatusInternalServerError, errInternalAppError)
+				}
+				return false
+			}
+			ctx.SSEvent("error", err.Error())
+		}
+		ctx.SSEvent("message", "[DONE]")
+		return false
+	})
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/llm"
+)
+
+func TestServerRejected(t *testing.T) {
+	c := config.New()
+	c.ModelConfigs["test"] = config.ModelConfig{Name: "test", Queue: config.QueueConfig{RetryAfter: 1500 * time.Millisecond}}
+	s := newTestServer(c)
+
+	cases := []struct {
+		name       string
+		modelName  string
+		err        error
+		rejected   bool
+		status     int
+		retryAfter string
+	}{
+		{name: "full", modelName: "test", err: llm.ErrQueueFull, rejected: true, status: http.StatusTooManyRequests, retryAfter: "2"},
+		{name: "timeout", modelName: "test", err: llm.ErrQueueTimeout, rejected: true, status: http.StatusServiceUnavailable, retryAfter: "2"},
+		{name: "wrapped", modelName: "test", err: errors.Join(errors.New("queue"), llm.ErrQueueFull), rejected: true, status: http.StatusTooManyRequests, retryAfter: "2"},
+		{name: "default retry after", modelName: "other", err: llm.ErrQueueFull, rejected: true, status: http.StatusTooManyRequests, retryAfter: "1"},
+		{name: "other error", modelName: "test", err: errors.New("failed"), rejected: false},
+	}
+	for _, c := range cases {
+		ctx, recorder := newTestContext("")
+		if rejected := s.rejected(ctx, c.modelName, c.err); rejected != c.rejected {
+			t.Errorf("%s: expected rejected %v, got: %v", c.name, c.rejected, rejected)
+			continue
+		}
+		if !c.rejected {
+			continue
+		}
+		if recorder.Code != c.status {
+			t.Errorf("%s: expected status %d, got: %d", c.name, c.status, recorder.Code)
+		}
+		if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != c.retryAfter {
+			t.Errorf("%s: expected retry after %s, got: %s", c.name, c.retryAfter, retryAfter)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/llm"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// defaultTemperature and defaultTopP are used when neither request nor model sets them, as openai api does
+const (
+	defaultTemperature float32 = 1
+	defaultTopP        float32 = 1
+)
+
+// defaultCFGScale is used when negative prompt is set without cfg scale
+const defaultCFGScale float32 = 1.5
+
+// validate checks values of sampling fields, logits processors are checked after merged with sampling defaults
+// of model
+func (req *SamplingRequest) validate(defaults config.SamplingConfig) error {
+	if req.Mirostat != nil && (*req.Mirostat < 0 || *req.Mirostat > 2) {
+		return errInvalidMirostat
+	}
+	if req.Temperature != nil && *req.Temperature < 0 {
+		return errInvalidTemperature
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return errInvalidTopP
+	}
+	if req.MinP != nil && (*req.MinP < 0 || *req.MinP > 1) {
+		return errInvalidMinP
+	}
+	if (req.XTCProbability != nil && (*req.XTCProbability < 0 || *req.XTCProbability > 1)) ||
+		(req.XTCThreshold != nil && (*req.XTCThreshold < 0 || *req.XTCThreshold > 1)) {
+		return errInvalidXTC
+	}
+	return model.ValidateLogitsProcessors(logitsProcessors(req, defaults))
+}
+
+// logitsProcessors returns names of logits processors of request or model, nil means the default processors
+func logitsProcessors(req *SamplingRequest, defaults config.SamplingConfig) []string {
+	if req.LogitsProcessors != nil {
+		return req.LogitsProcessors
+	}
+	return defaults.LogitsProcessors
+}
+
+// samplingOptions merges sampling fields of request with sampling defaults of model, request fields take precedence
+func samplingOptions(req SamplingRequest, defaults config.SamplingConfig) []llm.Option {
+	temperature := pick(req.Temperature, defaults.Temperature)
+	if temperature == nil {
+		temperature = ptr(defaultTemperature)
+	}
+	topP := pick(req.TopP, defaults.TopP)
+	if topP == nil {
+		topP = ptr(defaultTopP)
+	}
+
+	options := []model.SampleOption{model.WithTemp(*temperature), model.WithTopP(*topP)}
+	if v := pick(req.TopK, defaults.TopK); v != nil {
+		options = append(options, model.WithTopK(*v))
+	}
+	if v := pick(req.TfsZ, defaults.TfsZ); v != nil {
+		options = append(options, model.WithTfsZ(*v))
+	}
+	if v := pick(req.TypicalP, defaults.TypicalP); v != nil {
+		options = append(options, model.WithTypicalP(*v))
+	}
+	if v := pick(req.RepeatPenalty, defaults.RepeatPenalty); v != nil {
+		options = append(options, model.WithRepeatPenalty(*v))
+	}
+	if v := pick(req.RepeatLastN, defaults.RepeatLastN); v != nil {
+		options = append(options, model.WithRepeatLastN(*v))
+	}
+	if v := pick(req.FrequencyPenalty, defaults.FrequencyPenalty); v != nil {
+		options = append(options, model.WithFrequenctPenalty(*v))
+	}
+	if v := pick(req.PresencePenalty, defaults.PresencePenalty); v != nil {
+		options = append(options, model.WithPresencePenalty(*v))
+	}
+	if v := pick(req.Mirostat, defaults.Mirostat); v != nil {
+		options = append(options, model.WithMirostat(*v))
+	}
+	if v := pick(req.MirostatTau, defaults.MirostatTau); v != nil {
+		options = append(options, model.WithMirostatTau(*v))
+	}
+	if v := pick(req.MirostatEta, defaults.MirostatEta); v != nil {
+		options = append(options, model.WithMirostatEta(*v))
+	}
+	if v := pick(req.PenalizeNL, defaults.PenalizeNL); v != nil {
+		options = append(options, model.WithPenalizeNL(*v))
+	}
+	if v := pick(req.MinP, defaults.MinP); v != nil {
+		options = append(options, model.WithMinP(*v))
+	}
+	if v := pick(req.TopA, defaults.TopA); v != nil {
+		options = append(options, model.WithTopA(*v))
+	}
+	if v := pick(req.DryMultiplier, defaults.DryMultiplier); v != nil {
+		options = append(options, model.WithDryMultiplier(*v))
+	}
+	if v := pick(req.DryBase, defaults.DryBase); v != nil {
+		options = append(options, model.WithDryBase(*v))
+	}
+	if v := pick(req.DryAllowedLength, defaults.DryAllowedLength); v != nil {
+		options = append(options, model.WithDryAllowedLength(*v))
+	}
+	if v := pick(req.DryPenaltyLastN, defaults.DryPenaltyLastN); v != nil {
+		options = append(options, model.WithDryPenaltyLastN(*v))
+	}
+	if req.DrySequenceBreakers != nil {
+		options = append(options, model.WithDrySequenceBreakers(req.DrySequenceBreakers))
+	} else if defaults.DrySequenceBreakers != nil {
+		options = append(options, model.WithDrySequenceBreakers(defaults.DrySequenceBreakers))
+	}
+	if v := pick(req.XTCProbability, defaults.XTCProbability); v != nil {
+		options = append(options, model.WithXTCProbability(*v))
+	}
+	if v := pick(req.XTCThreshold, defaults.XTCThreshold); v != nil {
+		options = append(options, model.WithXTCThreshold(*v))
+	}
+	if names := logitsProcessors(&req, defaults); names != nil {
+		options = append(options, model.WithLogitsProcessors(names))
+	}
+
+	llmOptions := []llm.Option{llm.WithSampleOptions(options...)}
+	if v := pick(req.Seed, defaults.Seed); v != nil {
+		llmOptions = append(llmOptions, llm.WithSeed(*v))
+	}
+	return llmOptions
+}
+
+// pick returns the first value which is set
+func pick[T any](values ...*T) *T {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// contextShiftOptions merges context shift fields of request with context shift config of model, request fields
+// take precedence
+func contextShiftOptions(req ContextShiftRequest, defaults config.ContextShiftConfig) []llm.Option {
+	enable := defaults.Enable
+	if req.ContextShift != nil {
+		enable = *req.ContextShift
+	}
+	if !enable {
+		return nil
+	}
+	keepNum := defaults.Keep
+	if req.NKeep != nil {
+		keepNum = *req.NKeep
+	}
+	return []llm.Option{llm.WithContextShift(keepNum)}
+}
+
+// validate checks beam search fields against n, stream and grammar of request
+func (req *BeamSearchRequest) validate(n int, stream, grammar bool) error {
+	if req.NumBeams <= 1 {
+		return nil
+	}
+	if n > req.NumBeams {
+		return errInvalidNumBeams
+	}
+	if req.NumBeams > maxNumBeams {
+		return errTooManyBeams
+	}
+	if stream {
+		return errStreamBeamSearch
+	}
+	if grammar {
+		return errBeamSearchGrammar
+	}
+	return nil
+}
+
+// beamSearchOptions returns options enabling beam search, nil if it is not requested
+func beamSearchOptions(req BeamSearchRequest) []llm.Option {
+	if req.NumBeams <= 1 {
+		return nil
+	}
+	lengthPenalty := float32(1)
+	if req.LengthPenalty != nil {
+		lengthPenalty = *req.LengthPenalty
+	}
+	return []llm.Option{llm.WithBeamSearch(req.NumBeams, lengthPenalty, req.EarlyStopping)}
+}
+
+// validate checks guidance fields, enabled tells if model has guidance contexts
+func (req *GuidanceRequest) validate(enabled bool, numBeams int) error {
+	if req.CFGScale != nil && *req.CFGScale <= 0 {
+		return errInvalidCFGScale
+	}
+	if req.NegativePrompt == "" {
+		return nil
+	}
+	if !enabled {
+		return errGuidanceDisabled
+	}
+	if numBeams > 1 {
+		return errBeamSearchGuidance
+	}
+	return nil
+}
+
+// guidanceOptions returns options enabling classifier-free guidance, nil if there is no negative prompt
+func guidanceOptions(req GuidanceRequest) []llm.Option {
+	if req.NegativePrompt == "" {
+		return nil
+	}
+	cfgScale := defaultCFGScale
+	if req.CFGScale != nil {
+		cfgScale = *req.CFGScale
+	}
+	return []llm.Option{llm.WithGuidance(req.NegativePrompt, cfgScale)}
+}
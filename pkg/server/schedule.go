@@ -0,0 +1,42 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/llm"
+)
+
+const (
+	// chatPriority is the default priority of chat completions, which are usually interactive
+	chatPriority = 1
+	// completionPriority is the default priority of completions
+	completionPriority = 0
+)
+
+// scheduleOptions returns options deciding the order of request in queue
+func (s *Server) scheduleOptions(ctx *gin.Context, user string, priority *int, defaultPriority int) []llm.Option {
+	return []llm.Option{llm.WithUser(user), llm.WithPriority(s.priority(ctx, priority, defaultPriority))}
+}
+
+// priority returns the effective priority of request. The priority class of api key caps priority of request, and
+// is used when it is not set. Requests without a class are capped by defaultPriority of their endpoint, so they can
+// only lower it.
+func (s *Server) priority(ctx *gin.Context, priority *int, defaultPriority int) int {
+	limit := defaultPriority
+	key := apiKey(ctx)
+	if class, ok := s.ctx.Config.APIKeyPriorities[key]; ok && key != "" {
+		limit = class
+	}
+
+	if priority != nil && *priority < limit {
+		return *priority
+	}
+	return limit
+}
+
+// apiKey returns bearer token of request, empty if it is not set
+func apiKey(ctx *gin.Context) string {
+	return strings.TrimSpace(strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer "))
+}
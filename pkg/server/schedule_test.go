@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/context"
+)
+
+func newTestServer(c *config.Config) *Server {
+	return &Server{ctx: context.New(c)}
+}
+
+// newTestContext returns a gin context of request with api key, empty key means no authorization header
+func newTestContext(key string) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	if key != "" {
+		ctx.Request.Header.Set("Authorization", "Bearer "+key)
+	}
+	return ctx, recorder
+}
+
+func TestServerPriority(t *testing.T) {
+	c := config.New()
+	c.APIKeyPriorities["batch"] = -10
+	c.APIKeyPriorities["vip"] = 10
+	s := newTestServer(c)
+
+	cases := []struct {
+		name            string
+		key             string
+		priority        *int
+		defaultPriority int
+		expected        int
+	}{
+		{name: "chat default", defaultPriority: chatPriority, expected: chatPriority},
+		{name: "completion default", defaultPriority: completionPriority, expected: completionPriority},
+		{name: "unclassed raise is capped", priority: ptr(100), defaultPriority: chatPriority, expected: chatPriority},
+		{name: "unclassed lower", priority: ptr(-5), defaultPriority: chatPriority, expected: -5},
+		{name: "unknown key is unclassed", key: "other", priority: ptr(100), defaultPriority: completionPriority, expected: completionPriority},
+		{name: "class is used by default", key: "vip", defaultPriority: completionPriority, expected: 10},
+		{name: "class caps priority", key: "batch", priority: ptr(5), defaultPriority: chatPriority, expected: -10},
+		{name: "class lower", key: "vip", priority: ptr(3), defaultPriority: chatPriority, expected: 3},
+	}
+	for _, c := range cases {
+		ctx, _ := newTestContext(c.key)
+		if got := s.priority(ctx, c.priority, c.defaultPriority); got != c.expected {
+			t.Errorf("%s: expected priority %d, got: %d", c.name, c.expected, got)
+		}
+	}
+}
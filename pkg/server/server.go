@@ -1,6 +1,7 @@
 package server
 
 import (
+	"expvar"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
@@ -27,10 +28,37 @@ func New(ctx *context.Context) *Server {
 	v1.POST("/embeddings", s.embedding)
 	v1.POST("/completions", s.completion)
 	v1.POST("/chat/completions", s.chatCompletion)
+	v1.GET("/sessions", s.listSessions)
+	v1.GET("/sessions/:id", s.retrieveSession)
+	v1.DELETE("/sessions/:id", s.deleteSession)
+
+	r.GET("/metrics", metrics)
 	return s
 
 }
 
+// metricNames is names of published expvars exposed by metrics, others such as cmdline are kept private
+var metricNames = []string{"scheduler", "speculative"}
+
+// metrics writes metricNames in the format of expvar handler
+func metrics(ctx *gin.Context) {
+	ctx.Header("Content-Type", "application/json; charset=utf-8")
+	ctx.Writer.WriteString("{\n")
+	first := true
+	for _, name := range metricNames {
+		v := expvar.Get(name)
+		if v == nil {
+			continue
+		}
+		if !first {
+			ctx.Writer.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(ctx.Writer, "%q: %s", name, v.String())
+	}
+	ctx.Writer.WriteString("\n}\n")
+}
+
 // Run run the server
 func (s *Server) Run() {
 	address := fmt.Sprintf("%s:%d", s.ctx.Config.Host, s.ctx.Config.Port)
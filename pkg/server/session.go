@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/llm"
+	"github.com/bdqfork/go-llama.cpp/pkg/session"
+)
+
+// sessionHeader carries id of chat session, session_id of request takes precedence
+const sessionHeader = "X-Session-ID"
+
+// chatSessionID returns id of chat session of request scoped to its api key, empty if request has no session.
+// A session without explicit id falls back to user, which is hashed since it is an arbitrary string.
+func chatSessionID(ctx *gin.Context, req *ChatCompletionRequest) (string, error) {
+	id := req.SessionID
+	if id == "" {
+		id = ctx.GetHeader(sessionHeader)
+	}
+	if id == "" {
+		if req.User == "" {
+			return "", nil
+		}
+		sum := sha256.Sum256([]byte(req.User))
+		id = "user-" + hex.EncodeToString(sum[:16])
+	}
+	if err := session.ValidateID(id); err != nil {
+		return "", err
+	}
+	return tenant(ctx) + "." + id, nil
+}
+
+// tenant returns scope of sessions of request, which is derived from its api key. Requests without api key share
+// a tenant, whose sessions are only reachable by chat.
+func tenant(ctx *gin.Context) string {
+	sum := sha256.Sum256([]byte(apiKey(ctx)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sessionTenant returns tenant of request to session endpoints, which requires an api key, so that sessions of
+// anonymous requests are not listed or removed by anyone
+func sessionTenant(ctx *gin.Context) (string, bool) {
+	if apiKey(ctx) == "" {
+		ctx.JSON(http.StatusUnauthorized, errAPIKeyRequired.Error())
+		return "", false
+	}
+	return tenant(ctx), true
+}
+
+// scopedSessionID returns id of session param scoped to api key of request
+func scopedSessionID(ctx *gin.Context) (string, bool) {
+	t, ok := sessionTenant(ctx)
+	if !ok {
+		return "", false
+	}
+	id := ctx.Param("id")
+	if err := session.ValidateID(id); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return t + "." + id, true
+}
+
+// sessionStores returns session stores of model query, or of all models with session enabled if it is not set.
+// Models are not loaded.
+func (s *Server) sessionStores(ctx *gin.Context) (map[string]session.Store, bool) {
+	modelName := ctx.Query("model")
+	if _, ok := s.ctx.Config.ModelConfigs[modelName]; modelName != "" && !ok {
+		ctx.JSON(http.StatusNotFound, errModelNotFound.Error())
+		return nil, false
+	}
+	stores, err := s.ctx.SessionStores(modelName)
+	if err != nil {
+		klog.Errorf("failed to open session stores, err: %v", err)
+		ctx.JSON(http.StatusInternalServerError, errInternalAppError)
+		return nil, false
+	}
+	return stores, true
+}
+
+func (s *Server) listSessions(ctx *gin.Context) {
+	t, ok := sessionTenant(ctx)
+	if !ok {
+		return
+	}
+
+	startTime := time.Now()
+	klog.V(3).Infof("received list sessions request")
+	defer func() {
+		klog.V(3).Infof("finished list sessions request, took: %v", time.Since(startTime))
+	}()
+
+	stores, ok := s.sessionStores(ctx)
+	if !ok {
+		return
+	}
+
+	// sessions of other api keys are invisible
+	prefix := t + "."
+	sessions := make([]Session, 0)
+	for modelName, store := range stores {
+		infos, err := store.List()
+		if err != nil {
+			klog.Errorf("failed to list sessions of model %s, err: %v", modelName, err)
+			ctx.JSON(http.StatusInternalServerError, errInternalAppError)
+			return
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(info.ID, prefix) {
+				sessions = append(sessions, newSession(modelName, info))
+			}
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed > sessions[j].LastUsed
+	})
+
+	rsp := map[string]interface{}{}
+	rsp["data"] = sessions
+	rsp["object"] = "list"
+	ctx.JSON(http.StatusOK, rsp)
+}
+
+func (s *Server) retrieveSession(ctx *gin.Context) {
+	id := ctx.Param("id")
+	scopedID, ok := scopedSessionID(ctx)
+	if !ok {
+		return
+	}
+
+	startTime := time.Now()
+	klog.V(3).Infof("received retrieve session request, session: %s", id)
+	defer func() {
+		klog.V(3).Infof("finished retrieve session request, session: %s, took: %v", id, time.Since(startTime))
+	}()
+
+	stores, ok := s.sessionStores(ctx)
+	if !ok {
+		return
+	}
+
+	sessions := make([]Session, 0)
+	for modelName, store := range stores {
+		info, err := store.Stat(scopedID)
+		if errors.Is(err, session.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			klog.Errorf("failed to retrieve session %s of model %s, err: %v", id, modelName, err)
+			ctx.JSON(http.StatusInternalServerError, errInternalAppError)
+			return
+		}
+		sessions = append(sessions, newSession(modelName, *info))
+	}
+	if len(sessions) == 0 {
+		ctx.JSON(http.StatusNotFound, errSessionNotFound.Error())
+		return
+	}
+	if len(sessions) == 1 {
+		ctx.JSON(http.StatusOK, sessions[0])
+		return
+	}
+	// the same session is kept by several models
+	rsp := map[string]interface{}{}
+	rsp["data"] = sessions
+	rsp["object"] = "list"
+	ctx.JSON(http.StatusOK, rsp)
+}
+
+func (s *Server) deleteSession(ctx *gin.Context) {
+	id := ctx.Param("id")
+	scopedID, ok := scopedSessionID(ctx)
+	if !ok {
+		return
+	}
+
+	startTime := time.Now()
+	klog.V(3).Infof("received delete session request, session: %s", id)
+	defer func() {
+		klog.V(3).Infof("finished delete session request, session: %s, took: %v", id, time.Since(startTime))
+	}()
+
+	stores, ok := s.sessionStores(ctx)
+	if !ok {
+		return
+	}
+
+	// a loaded model also drops the state held by its contexts
+	llms := s.ctx.LoadedLLMs()
+	for modelName, store := range stores {
+		var err error
+		if l, ok := llms[modelName]; ok {
+			err = l.EndSession(scopedID)
+		} else {
+			err = store.Delete(scopedID)
+		}
+		if err != nil {
+			klog.Errorf("failed to delete session %s of model %s, err: %v", id, modelName, err)
+			ctx.JSON(http.StatusInternalServerError, errInternalAppError)
+			return
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"id": id, "object": "session", "deleted": true})
+}
+
+// endSession frees state of chat session id after a request
+func endSession(l llm.LLM, id string) {
+	if id == "" {
+		return
+	}
+	if err := l.EndSession(id); err != nil {
+		klog.Errorf("failed to end session %s, err: %v", id, err)
+	}
+}
+
+// newSession returns session of info, whose id is scoped by tenant
+func newSession(modelName string, info session.Info) Session {
+	id := info.ID
+	if i := strings.IndexByte(id, '.'); i >= 0 {
+		id = id[i+1:]
+	}
+	return Session{
+		ID:       id,
+		Object:   "session",
+		Model:    modelName,
+		Tokens:   info.Tokens,
+		Size:     info.Size,
+		LastUsed: info.LastUsed.Unix(),
+	}
+}
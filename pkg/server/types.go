@@ -1,15 +1,43 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 
 	"github.com/bdqfork/go-llama.cpp/pkg/llm"
 )
 
+const (
+	maxTopLogprobs = 20
+	// maxNumBeams bounds beam search, every beam keeps a snapshot of context and twice as many are evaluated
+	maxNumBeams = 16
+)
+
 var (
-	errUnableToLoadModel = errors.New("unable to load model")
-	errInternalAppError  = errors.New("internal application error")
-	errProcessingFailed  = errors.New("processing failed")
+	errUnableToLoadModel   = errors.New("unable to load model")
+	errInternalAppError    = errors.New("internal application error")
+	errProcessingFailed    = errors.New("processing failed")
+	errInvalidBestOf       = errors.New("best_of must be greater than or equal to n")
+	errStreamBestOf        = errors.New("best_of greater than n is not supported in stream")
+	errInvalidLogprobs     = errors.New("logprobs must be between 0 and 20")
+	errGrammarConflict     = errors.New("grammar and response_format can not be used together")
+	errToolConflict        = errors.New("grammar and response_format can not be used with required tool calls")
+	errInvalidMirostat     = errors.New("mirostat must be 0, 1 or 2")
+	errInvalidTemperature  = errors.New("temperature must be greater than or equal to 0")
+	errInvalidMinP         = errors.New("min_p must be between 0 and 1")
+	errInvalidXTC          = errors.New("xtc_probability and xtc_threshold must be between 0 and 1")
+	errInvalidTopP         = errors.New("top_p must be between 0 and 1")
+	errSessionNotFound     = errors.New("session not found")
+	errAPIKeyRequired      = errors.New("sessions can only be managed with an api key")
+	errModelNotFound       = errors.New("model not found")
+	errInvalidLastMessages = errors.New("last_messages must be greater than 0")
+	errInvalidNumBeams     = errors.New("num_beams must be greater than or equal to n")
+	errTooManyBeams        = errors.New("num_beams must be less than or equal to 16")
+	errStreamBeamSearch    = errors.New("num_beams greater than 1 is not supported in stream")
+	errBeamSearchGrammar   = errors.New("grammar, response_format and required tool calls can not be used with beam search")
+	errInvalidCFGScale     = errors.New("cfg_scale must be greater than 0")
+	errGuidanceDisabled    = errors.New("negative_prompt is not supported, guidance is not enabled for model")
+	errBeamSearchGuidance  = errors.New("negative_prompt can not be used with beam search")
 )
 
 // Model ...
@@ -20,6 +48,18 @@ type Model struct {
 	Permission []string `json:"permission"`
 }
 
+// Session is a stored chat session of model
+type Session struct {
+	ID     string `json:"id"`
+	Object string `json:"object"`
+	Model  string `json:"model"`
+	// Tokens is the number of evaluated tokens in state
+	Tokens int `json:"tokens"`
+	// Size is bytes used by state
+	Size     int64 `json:"size"`
+	LastUsed int64 `json:"last_used"`
+}
+
 // EmbeddingRequest ...
 type EmbeddingRequest struct {
 	Model string `json:"model" bind:"required"`
@@ -29,36 +69,138 @@ type EmbeddingRequest struct {
 
 // CompletionRequest ...
 type CompletionRequest struct {
-	Model            string          `json:"model" bind:"required"`
-	Prompt           any             `json:"prompt"`
-	Suffix           string          `json:"suffix"`
-	MaxTokens        int             `json:"max_tokens"`
-	Temperature      float32         `json:"temperature"`
-	TopP             float32         `json:"top_p"`
-	N                int             `json:"n"`
-	Stream           bool            `json:"stream"`
-	Logprobs         int             `json:"log_probs"`
-	Echo             bool            `json:"echo"`
-	Stop             any             `json:"stop"`
-	PresencePenalty  float32         `json:"presence_penalty"`
-	FrequencyPenalty float32         `json:"frequency_penalty"`
-	BestOf           int             `json:"best_of"`
-	LogitBias        map[int]float32 `json:"logit_bias"`
-	User             string          `json:"user"`
+	Model         string          `json:"model" bind:"required"`
+	Prompt        any             `json:"prompt"`
+	Suffix        string          `json:"suffix"`
+	MaxTokens     int             `json:"max_tokens"`
+	N             int             `json:"n"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *StreamOptions  `json:"stream_options"`
+	Logprobs      *int            `json:"logprobs"`
+	Echo          bool            `json:"echo"`
+	Stop          any             `json:"stop"`
+	StopTokenIDs  []int           `json:"stop_token_ids"`
+	BestOf        int             `json:"best_of"`
+	LogitBias     map[int]float32 `json:"logit_bias"`
+	Grammar       string          `json:"grammar"`
+	User          string          `json:"user"`
+	Priority      *int            `json:"priority"`
+	SamplingRequest
+	ContextShiftRequest
+	BeamSearchRequest
+	GuidanceRequest
 }
 
 // ChatCompletionRequest ...
 type ChatCompletionRequest struct {
-	Model            string                      `json:"model" bind:"required"`
-	Messages         []llm.ChatCompletionMessage `json:"messages" bind:"required"`
-	Temperature      float32                     `json:"temperature"`
-	TopP             float32                     `json:"top_p"`
-	N                int                         `json:"n"`
-	Stream           bool                        `json:"stream"`
-	Stop             any                         `json:"stop"`
-	MaxTokens        int                         `json:"max_tokens"`
-	PresencePenalty  float32                     `json:"presence_penalty"`
-	FrequencyPenalty float32                     `json:"frequency_penalty"`
-	LogitBias        map[int]float32             `json:"logit_bias"`
-	User             string                      `json:"user"`
+	Model          string                      `json:"model" bind:"required"`
+	Messages       []llm.ChatCompletionMessage `json:"messages" bind:"required"`
+	N              int                         `json:"n"`
+	Stream         bool                        `json:"stream"`
+	StreamOptions  *StreamOptions              `json:"stream_options"`
+	Stop           any                         `json:"stop"`
+	StopTokenIDs   []int                       `json:"stop_token_ids"`
+	MaxTokens      int                         `json:"max_tokens"`
+	LogitBias      map[int]float32             `json:"logit_bias"`
+	Logprobs       bool                        `json:"logprobs"`
+	TopLogprobs    int                         `json:"top_logprobs"`
+	Grammar        string                      `json:"grammar"`
+	ResponseFormat *ResponseFormat             `json:"response_format"`
+	Tools          []llm.Tool                  `json:"tools"`
+	ToolChoice     any                         `json:"tool_choice"`
+	User           string                      `json:"user"`
+	Priority       *int                        `json:"priority"`
+	// SessionID identifies the conversation whose state is kept, user is used when it is not set
+	SessionID string `json:"session_id"`
+	// EndSession frees state of chat session after the response
+	EndSession bool `json:"end_session"`
+	// TruncationStrategy overrides how model truncates messages exceeding context
+	TruncationStrategy *TruncationStrategy `json:"truncation_strategy"`
+	SamplingRequest
+	ContextShiftRequest
+	BeamSearchRequest
+	GuidanceRequest
+}
+
+// ContextShiftRequest is context shift fields shared by completion and chat completion, unset fields fall back to
+// model context shift config
+type ContextShiftRequest struct {
+	// ContextShift keeps generating when context is full, by discarding half of tokens after the first n_keep
+	ContextShift *bool `json:"context_shift"`
+	// NKeep is the number of leading tokens kept, -1 keeps the whole prompt
+	NKeep *int `json:"n_keep"`
+}
+
+// BeamSearchRequest is beam search fields shared by completion and chat completion
+type BeamSearchRequest struct {
+	// NumBeams enables beam search instead of sampling when greater than 1, the best n beams are returned. It is at
+	// most 16.
+	NumBeams int `json:"num_beams"`
+	// LengthPenalty is the exponent of length dividing log probability of finished beams, 1 by default
+	LengthPenalty *float32 `json:"length_penalty"`
+	// EarlyStopping stops search as soon as num_beams beams are finished
+	EarlyStopping bool `json:"early_stopping"`
+}
+
+// GuidanceRequest is classifier-free guidance fields shared by completion and chat completion
+type GuidanceRequest struct {
+	// NegativePrompt is the prompt generation is steered away from, it is the system message of chat completion
+	NegativePrompt string `json:"negative_prompt"`
+	// CFGScale is the strength of guidance, 1 means no guidance, 1.5 by default
+	CFGScale *float32 `json:"cfg_scale"`
+}
+
+// TruncationStrategy is strategy of chat history which exceeds context, type is one of none, drop_oldest,
+// last_messages, middle_out and summarize
+type TruncationStrategy struct {
+	Type         string `json:"type"`
+	LastMessages *int   `json:"last_messages"`
+}
+
+// StreamOptions ...
+type StreamOptions struct {
+	// IncludeQueuePosition sends queue events with position of request, while it waits for the model
+	IncludeQueuePosition bool `json:"include_queue_position"`
+}
+
+// SamplingRequest is sampling fields shared by completion and chat completion, unset fields fall back to model
+// sampling config
+type SamplingRequest struct {
+	Temperature         *float32 `json:"temperature"`
+	TopP                *float32 `json:"top_p"`
+	TopK                *int     `json:"top_k"`
+	TfsZ                *float32 `json:"tfs_z"`
+	TypicalP            *float32 `json:"typical_p"`
+	RepeatPenalty       *float32 `json:"repeat_penalty"`
+	RepeatLastN         *int     `json:"repeat_last_n"`
+	PresencePenalty     *float32 `json:"presence_penalty"`
+	FrequencyPenalty    *float32 `json:"frequency_penalty"`
+	Mirostat            *int     `json:"mirostat"`
+	MirostatTau         *float32 `json:"mirostat_tau"`
+	MirostatEta         *float32 `json:"mirostat_eta"`
+	PenalizeNL          *bool    `json:"penalize_nl"`
+	Seed                *int     `json:"seed"`
+	MinP                *float32 `json:"min_p"`
+	TopA                *float32 `json:"top_a"`
+	DryMultiplier       *float32 `json:"dry_multiplier"`
+	DryBase             *float32 `json:"dry_base"`
+	DryAllowedLength    *int     `json:"dry_allowed_length"`
+	DryPenaltyLastN     *int     `json:"dry_penalty_last_n"`
+	DrySequenceBreakers []string `json:"dry_sequence_breakers"`
+	XTCProbability      *float32 `json:"xtc_probability"`
+	XTCThreshold        *float32 `json:"xtc_threshold"`
+	LogitsProcessors    []string `json:"logits_processors"`
+}
+
+// ResponseFormat ...
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema"`
+}
+
+// JSONSchemaFormat ...
+type JSONSchemaFormat struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict"`
 }
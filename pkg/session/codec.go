@@ -0,0 +1,217 @@
+package session
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// EncryptionKeyEnv is the environment variable of encryption key, used when it is not configured
+const EncryptionKeyEnv = "GO_LLAMA_SESSION_KEY"
+
+const (
+	stateMagic   = "GLSS"
+	stateVersion = 1
+	// headerSize is size of magic, version, flags and token num
+	headerSize = len(stateMagic) + 2 + 4
+)
+
+// flags of encoded state
+const (
+	flagCompressed = 1 << iota
+	flagEncrypted
+)
+
+// ErrCorrupt is returned when a persisted state fails integrity check, it should be discarded
+var ErrCorrupt = errors.New("corrupt session state")
+
+// Codec encodes states persisted by stores. An encoded state starts with a plain header, which holds token num
+// so that state can be listed without decoding. The rest is optionally compressed, then authenticated with
+// AES-GCM if a key is set, or checked by crc32 otherwise.
+type Codec struct {
+	compress bool
+	aead     cipher.AEAD
+}
+
+// NewCodec returns a codec, key is an AES key of 16, 24 or 32 bytes, nil key disables encryption
+func NewCodec(compress bool, key []byte) (*Codec, error) {
+	c := &Codec{compress: compress}
+	if key == nil {
+		return c, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session encryption key, err: %v", err)
+	}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newCodec returns codec configured by session config, encryption key falls back to environment variable
+func newCodec(sessionConfig config.SessionConfig) (*Codec, error) {
+	encoded := sessionConfig.EncryptionKey
+	if encoded == "" {
+		encoded = os.Getenv(EncryptionKeyEnv)
+	}
+	if encoded == "" {
+		return NewCodec(sessionConfig.Compress, nil)
+	}
+	key, err := decodeKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return NewCodec(sessionConfig.Compress, key)
+}
+
+// decodeKey decodes key in hex or base64
+func decodeKey(encoded string) ([]byte, error) {
+	if key, err := hex.DecodeString(encoded); err == nil {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("session encryption key must be hex or base64 encoded")
+}
+
+// Encode returns encoded state
+func (c *Codec) Encode(state *model.State) ([]byte, error) {
+	body := &bytes.Buffer{}
+	body.Grow(len(state.Tokens)*4 + len(state.Data))
+	tokens := make([]int32, len(state.Tokens))
+	for i, token := range state.Tokens {
+		tokens[i] = int32(token)
+	}
+	if err := binary.Write(body, binary.LittleEndian, tokens); err != nil {
+		return nil, err
+	}
+	body.Write(state.Data)
+
+	flags := byte(0)
+	payload := body.Bytes()
+	if c.compress {
+		flags |= flagCompressed
+		compressed := &bytes.Buffer{}
+		w, err := flate.NewWriter(compressed, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload = compressed.Bytes()
+	}
+	if c.aead != nil {
+		flags |= flagEncrypted
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, stateMagic)
+	header[len(stateMagic)] = stateVersion
+	header[len(stateMagic)+1] = flags
+	binary.LittleEndian.PutUint32(header[len(stateMagic)+2:], uint32(len(tokens)))
+
+	if c.aead == nil {
+		data := append(header, payload...)
+		return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data)), nil
+	}
+	// header is authenticated with payload, nonce is put before sealed payload
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(payload)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return append(header, c.aead.Seal(nonce, nonce, payload, header)...), nil
+}
+
+// Decode returns state of data encoded by Encode, ErrCorrupt if data fails integrity check
+func (c *Codec) Decode(data []byte) (*model.State, error) {
+	tokenNum, flags, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	header, payload := data[:headerSize], data[headerSize:]
+
+	if flags&flagEncrypted != 0 {
+		if c.aead == nil {
+			return nil, fmt.Errorf("session state is encrypted, but no encryption key is set")
+		}
+		if len(payload) < c.aead.NonceSize() {
+			return nil, fmt.Errorf("%w: truncated", ErrCorrupt)
+		}
+		nonce, sealed := payload[:c.aead.NonceSize()], payload[c.aead.NonceSize():]
+		if payload, err = c.aead.Open(nil, nonce, sealed, header); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	} else {
+		// a plain state could be forged when states are expected to be encrypted
+		if c.aead != nil {
+			return nil, fmt.Errorf("%w: state is not encrypted", ErrCorrupt)
+		}
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("%w: truncated", ErrCorrupt)
+		}
+		sum := binary.LittleEndian.Uint32(payload[len(payload)-4:])
+		if crc32.ChecksumIEEE(data[:len(data)-4]) != sum {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+		}
+		payload = payload[:len(payload)-4]
+	}
+
+	if flags&flagCompressed != 0 {
+		r := flate.NewReader(bytes.NewReader(payload))
+		defer r.Close()
+		if payload, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+
+	if len(payload) < tokenNum*4 {
+		return nil, fmt.Errorf("%w: truncated", ErrCorrupt)
+	}
+	state := &model.State{Tokens: make([]binding.Token, tokenNum), Data: payload[tokenNum*4:]}
+	for i := range state.Tokens {
+		state.Tokens[i] = binding.Token(int32(binary.LittleEndian.Uint32(payload[i*4:])))
+	}
+	return state, nil
+}
+
+// readTokenNum reads token num from header of encoded state, without reading the rest
+func readTokenNum(r io.Reader) (int, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	tokenNum, _, err := parseHeader(header)
+	return tokenNum, err
+}
+
+func parseHeader(data []byte) (tokenNum int, flags byte, err error) {
+	if len(data) < headerSize || string(data[:len(stateMagic)]) != stateMagic {
+		return 0, 0, fmt.Errorf("%w: invalid header", ErrCorrupt)
+	}
+	if version := data[len(stateMagic)]; version != stateVersion {
+		return 0, 0, fmt.Errorf("unsupported session state version: %d", version)
+	}
+	flags = data[len(stateMagic)+1]
+	tokenNum = int(binary.LittleEndian.Uint32(data[len(stateMagic)+2:]))
+	return tokenNum, flags, nil
+}
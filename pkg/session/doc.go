@@ -0,0 +1,2 @@
+// Package session provides stores which persist states of chat sessions
+package session
@@ -0,0 +1,168 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+const stateExt = ".state"
+
+type fileStore struct {
+	// dir is the directory of states of model
+	dir   string
+	codec *Codec
+}
+
+// NewFileStore returns a store which keeps each state in a file under directory of model name in path, states
+// are encoded by codec, nil codec stores plain states
+func NewFileStore(path, name string, codec *Codec) Store {
+	if codec == nil {
+		codec = &Codec{}
+	}
+	return &fileStore{dir: filepath.Join(path, name), codec: codec}
+}
+
+func (s *fileStore) Get(id string) (*model.State, error) {
+	path, err := s.filepath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	// modification time is the last use of state
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		klog.Warningf("failed to touch session %s, err: %v", id, err)
+	}
+	return state, nil
+}
+
+func (s *fileStore) Put(id string, state *model.State) error {
+	path, err := s.filepath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	data, err := s.codec.Encode(state)
+	if err != nil {
+		return err
+	}
+	// state is written into a temporary file of its own first, so that a reader never sees a partial state, and
+	// contexts saving the same session at once do not write the same file
+	f, err := os.CreateTemp(s.dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Delete(id string) error {
+	path, err := s.filepath(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) Stat(id string) (*Info, error) {
+	path, err := s.filepath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tokenNum, err := readTokenNum(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session %s, err: %v", id, err)
+	}
+	return &Info{ID: id, Tokens: tokenNum, Size: fi.Size(), LastUsed: fi.ModTime()}, nil
+}
+
+func (s *fileStore) List() ([]Info, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, stateExt) {
+			continue
+		}
+		id := strings.TrimSuffix(name, stateExt)
+		info, err := s.Stat(id)
+		if err == ErrNotFound || err == ErrInvalidID {
+			// removed since listed
+			continue
+		}
+		if err != nil {
+			klog.Warningf("failed to stat session %s, err: %v", id, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// filepath returns path of state file, id is validated so that the file is always in directory of store
+func (s *fileStore) filepath(id string) (string, error) {
+	if err := ValidateID(id); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, id+stateExt), nil
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+func TestFileStoreConcurrentPut(t *testing.T) {
+	store := NewFileStore(t.TempDir(), "test", nil)
+	states := make([]*model.State, 8)
+	for i := range states {
+		states[i] = &model.State{Tokens: []binding.Token{binding.Token(i)}, Data: []byte(fmt.Sprintf("state %d %0*d", i, 1<<16, i))}
+	}
+
+	wg := sync.WaitGroup{}
+	for _, state := range states {
+		wg.Add(1)
+		go func(state *model.State) {
+			defer wg.Done()
+			if err := store.Put("a", state); err != nil {
+				t.Errorf("failed to put, err: %v", err)
+			}
+		}(state)
+	}
+	wg.Wait()
+
+	// the session is one of the states as a whole, rather than a mix of them
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get, err: %v", err)
+	}
+	found := false
+	for _, state := range states {
+		found = found || reflect.DeepEqual(got, state)
+	}
+	if !found {
+		t.Errorf("expected one of the put states, got tokens: %v", got.Tokens)
+	}
+
+	entries, err := os.ReadDir(store.(*fileStore).dir)
+	if err != nil {
+		t.Fatalf("failed to read dir, err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files left, got: %v", entries)
+	}
+}
@@ -0,0 +1,136 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const defaultGCInterval = time.Minute
+
+// gcStore collects garbage of store periodically, until it is closed
+type gcStore struct {
+	Store
+	ttl      time.Duration
+	maxBytes int64
+	// legacy is collected along with store, nil if there is none
+	legacy *legacyFiles
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// WithGC returns a store which removes states unused longer than ttl, and the least recently used states when
+// all states take more than maxBytes. Zero ttl or maxBytes disables the respective collection.
+func WithGC(store Store, ttl time.Duration, maxBytes int64, interval time.Duration) Store {
+	return withGC(store, ttl, maxBytes, interval, nil)
+}
+
+func withGC(store Store, ttl time.Duration, maxBytes int64, interval time.Duration, legacy *legacyFiles) Store {
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	s := &gcStore{Store: store, ttl: ttl, maxBytes: maxBytes, legacy: legacy, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run(interval)
+	return s
+}
+
+func (s *gcStore) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.collect(); err != nil {
+				klog.Errorf("failed to collect sessions, err: %v", err)
+			}
+		}
+	}
+}
+
+func (s *gcStore) collect() error {
+	if s.legacy != nil {
+		if err := s.legacy.collect(s.ttl); err != nil {
+			klog.Errorf("failed to collect legacy session files, err: %v", err)
+		}
+	}
+	infos, err := s.List()
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastUsed.Before(infos[j].LastUsed)
+	})
+
+	total := int64(0)
+	for _, info := range infos {
+		total += info.Size
+	}
+
+	now := time.Now()
+	for _, info := range infos {
+		expired := s.ttl > 0 && now.Sub(info.LastUsed) > s.ttl
+		overflow := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !overflow {
+			continue
+		}
+		if err := s.Delete(info.ID); err != nil {
+			klog.Errorf("failed to delete session %s, err: %v", info.ID, err)
+			continue
+		}
+		total -= info.Size
+		klog.V(3).Infof("session %s collected, expired: %v, last used: %v", info.ID, expired, info.LastUsed)
+	}
+	return nil
+}
+
+func (s *gcStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.Store.Close()
+}
+
+// legacyFiles is session files written by llama session api before stores, named <path>/<model>-<id>.dat.
+// States can not be restored from them, so they are collected instead of migrated.
+type legacyFiles struct {
+	path string
+	name string
+}
+
+// collect removes legacy files unused longer than ttl, zero ttl removes all of them
+func (l *legacyFiles) collect(ttl time.Duration) error {
+	entries, err := os.ReadDir(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, l.name+"-") || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if ttl > 0 && now.Sub(fi.ModTime()) <= ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.path, name)); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("failed to remove legacy session file %s, err: %v", name, err)
+			continue
+		}
+		klog.V(3).Infof("legacy session file %s collected, last used: %v", name, fi.ModTime())
+	}
+	return nil
+}
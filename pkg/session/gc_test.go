@@ -0,0 +1,80 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLegacyFilesCollect(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]time.Time{
+		"test-old.dat":    old,
+		"test-new.dat":    time.Now(),
+		"other-old.dat":   old,
+		"test-old.state":  old,
+		"test-old.dat.gz": old,
+	}
+	for name, modTime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("ggsn"), 0o600); err != nil {
+			t.Fatalf("failed to write %s, err: %v", name, err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("failed to touch %s, err: %v", name, err)
+		}
+	}
+	remaining := func() []string {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir, err: %v", err)
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	legacy := &legacyFiles{path: dir, name: "test"}
+	if err := legacy.collect(time.Hour); err != nil {
+		t.Fatalf("failed to collect, err: %v", err)
+	}
+	if names := remaining(); !reflect.DeepEqual(names, []string{"other-old.dat", "test-new.dat", "test-old.dat.gz", "test-old.state"}) {
+		t.Errorf("expected only expired legacy files of model to be removed, got: %v", names)
+	}
+
+	if err := legacy.collect(0); err != nil {
+		t.Fatalf("failed to collect, err: %v", err)
+	}
+	if names := remaining(); !reflect.DeepEqual(names, []string{"other-old.dat", "test-old.dat.gz", "test-old.state"}) {
+		t.Errorf("expected all legacy files of model to be removed without ttl, got: %v", names)
+	}
+
+	missing := &legacyFiles{path: filepath.Join(dir, "missing"), name: "test"}
+	if err := missing.collect(0); err != nil {
+		t.Errorf("expected no error for missing path, got: %v", err)
+	}
+}
+
+func TestGCStoreMaxBytes(t *testing.T) {
+	store := WithGC(NewMemoryStore(1<<20, nil), 0, 250, time.Hour).(*gcStore)
+	defer store.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Put(id, sizedState(100)); err != nil {
+			t.Fatalf("failed to put, err: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.collect(); err != nil {
+		t.Fatalf("failed to collect, err: %v", err)
+	}
+	if ids := listIDs(t, store); !reflect.DeepEqual(ids, []string{"b", "c"}) {
+		t.Errorf("expected the least recently used session to be collected, got: %v", ids)
+	}
+}
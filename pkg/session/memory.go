@@ -0,0 +1,157 @@
+package session
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// memoryStore keeps states in memory within a byte budget. The least recently used states are evicted into
+// spill store if it is set, and loaded back on use.
+type memoryStore struct {
+	maxBytes int64
+	spill    Store
+
+	used    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	locker  sync.Mutex
+}
+
+type memoryEntry struct {
+	id       string
+	state    *model.State
+	lastUsed time.Time
+}
+
+// NewMemoryStore returns a store which keeps at most maxBytes of states in memory, spill can be nil
+func NewMemoryStore(maxBytes int64, spill Store) Store {
+	return &memoryStore{maxBytes: maxBytes, spill: spill, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *memoryStore) Get(id string) (*model.State, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if e, ok := s.entries[id]; ok {
+		s.lru.MoveToFront(e)
+		entry := e.Value.(*memoryEntry)
+		entry.lastUsed = time.Now()
+		return entry.state, nil
+	}
+
+	if s.spill == nil {
+		return nil, ErrNotFound
+	}
+	state, err := s.spill.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.spill.Delete(id); err != nil {
+		klog.Errorf("failed to delete spilled session %s, err: %v", id, err)
+	}
+	s.put(id, state)
+	return state, nil
+}
+
+func (s *memoryStore) Put(id string, state *model.State) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	// a spilled state of session is stale once it is replaced
+	if _, ok := s.entries[id]; !ok && s.spill != nil {
+		if err := s.spill.Delete(id); err != nil {
+			klog.Errorf("failed to delete spilled session %s, err: %v", id, err)
+		}
+	}
+	s.put(id, state)
+	return nil
+}
+
+func (s *memoryStore) put(id string, state *model.State) {
+	s.remove(id)
+	s.entries[id] = s.lru.PushFront(&memoryEntry{id: id, state: state, lastUsed: time.Now()})
+	s.used += int64(state.Size())
+
+	for s.used > s.maxBytes && s.lru.Len() > 0 {
+		entry := s.lru.Back().Value.(*memoryEntry)
+		s.remove(entry.id)
+		if s.spill == nil {
+			klog.V(3).Infof("session %s evicted from memory", entry.id)
+			continue
+		}
+		if err := s.spill.Put(entry.id, entry.state); err != nil {
+			klog.Errorf("failed to spill session %s, err: %v", entry.id, err)
+			continue
+		}
+		klog.V(3).Infof("session %s spilled from memory", entry.id)
+	}
+}
+
+func (s *memoryStore) remove(id string) bool {
+	e, ok := s.entries[id]
+	if !ok {
+		return false
+	}
+	s.used -= int64(e.Value.(*memoryEntry).state.Size())
+	s.lru.Remove(e)
+	delete(s.entries, id)
+	return true
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.remove(id)
+	if s.spill != nil {
+		return s.spill.Delete(id)
+	}
+	return nil
+}
+
+func (s *memoryStore) Stat(id string) (*Info, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if e, ok := s.entries[id]; ok {
+		info := e.Value.(*memoryEntry).info()
+		return &info, nil
+	}
+	if s.spill == nil {
+		return nil, ErrNotFound
+	}
+	return s.spill.Stat(id)
+}
+
+func (s *memoryStore) List() ([]Info, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	infos := make([]Info, 0, len(s.entries))
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		infos = append(infos, e.Value.(*memoryEntry).info())
+	}
+	if s.spill == nil {
+		return infos, nil
+	}
+	spilled, err := s.spill.List()
+	if err != nil {
+		return nil, err
+	}
+	return append(infos, spilled...), nil
+}
+
+func (s *memoryStore) Close() error {
+	if s.spill != nil {
+		return s.spill.Close()
+	}
+	return nil
+}
+
+func (e *memoryEntry) info() Info {
+	return Info{ID: e.id, Tokens: len(e.state.Tokens), Size: int64(e.state.Size()), LastUsed: e.lastUsed}
+}
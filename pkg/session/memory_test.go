@@ -0,0 +1,147 @@
+package session
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// sizedState returns a state of size bytes
+func sizedState(size int) *model.State {
+	return &model.State{Tokens: []binding.Token{1}, Data: make([]byte, size-4)}
+}
+
+func listIDs(t *testing.T, store Store) []string {
+	t.Helper()
+	infos, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list, err: %v", err)
+	}
+	ids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStore(300, nil)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Put(id, sizedState(100)); err != nil {
+			t.Fatalf("failed to put, err: %v", err)
+		}
+	}
+	// a is used after b, so b is the least recently used
+	if _, err := store.Get("a"); err != nil {
+		t.Fatalf("failed to get, err: %v", err)
+	}
+	if err := store.Put("d", sizedState(100)); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+
+	if ids := listIDs(t, store); !reflect.DeepEqual(ids, []string{"a", "c", "d"}) {
+		t.Errorf("expected sessions [a c d], got: %v", ids)
+	}
+	if _, err := store.Get("b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected evicted session to be not found, got: %v", err)
+	}
+}
+
+func TestMemoryStoreReplace(t *testing.T) {
+	store := NewMemoryStore(300, nil)
+	if err := store.Put("a", sizedState(200)); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	// the replaced state no longer counts against the budget
+	if err := store.Put("a", sizedState(100)); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	if err := store.Put("b", sizedState(200)); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	if ids := listIDs(t, store); !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("expected sessions [a b], got: %v", ids)
+	}
+	info, err := store.Stat("a")
+	if err != nil {
+		t.Fatalf("failed to stat, err: %v", err)
+	}
+	if info.Size != 100 || info.Tokens != 1 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestMemoryStoreSpill(t *testing.T) {
+	spill := NewFileStore(t.TempDir(), "test", nil)
+	store := NewMemoryStore(200, spill)
+	defer store.Close()
+
+	states := map[string]*model.State{}
+	for _, id := range []string{"a", "b", "c"} {
+		states[id] = sizedState(100)
+		states[id].Data[0] = id[0]
+		if err := store.Put(id, states[id]); err != nil {
+			t.Fatalf("failed to put, err: %v", err)
+		}
+	}
+	if _, err := spill.Stat("a"); err != nil {
+		t.Fatalf("expected a to be spilled, err: %v", err)
+	}
+	if ids := listIDs(t, store); !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+		t.Errorf("expected spilled sessions to be listed, got: %v", ids)
+	}
+
+	// a spilled state is loaded back, which spills the least recently used one in turn
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get spilled session, err: %v", err)
+	}
+	if !reflect.DeepEqual(got, states["a"]) {
+		t.Errorf("expected %v, got: %v", states["a"], got)
+	}
+	if _, err := spill.Stat("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected loaded session to leave spill store, got: %v", err)
+	}
+	if _, err := spill.Stat("b"); err != nil {
+		t.Errorf("expected b to be spilled, err: %v", err)
+	}
+
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("failed to delete, err: %v", err)
+	}
+	if _, err := store.Get("b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected deleted spilled session to be not found, got: %v", err)
+	}
+	if ids := listIDs(t, store); !reflect.DeepEqual(ids, []string{"a", "c"}) {
+		t.Errorf("expected sessions [a c], got: %v", ids)
+	}
+}
+
+func TestMemoryStorePutReplacesSpilled(t *testing.T) {
+	spill := NewMemoryStore(1<<20, nil)
+	store := NewMemoryStore(100, spill)
+	for _, id := range []string{"a", "b"} {
+		if err := store.Put(id, sizedState(100)); err != nil {
+			t.Fatalf("failed to put, err: %v", err)
+		}
+	}
+	// a is spilled, putting it again must not leave the stale copy behind
+	if err := store.Put("a", sizedState(50)); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	if ids := listIDs(t, store); !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("expected sessions [a b] listed once, got: %v", ids)
+	}
+	info, err := store.Stat("a")
+	if err != nil {
+		t.Fatalf("failed to stat, err: %v", err)
+	}
+	if info.Size != 50 {
+		t.Errorf("expected size of the new state, got: %+v", info)
+	}
+}
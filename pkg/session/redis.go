@@ -0,0 +1,296 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// defaultRedisTimeout bounds a command, so that a hung redis does not block the store forever
+	defaultRedisTimeout = 30 * time.Second
+)
+
+// redisStore keeps states in redis, so that server replicas share sessions. Information of sessions is kept
+// in a hash beside states. It speaks RESP over a single connection, which is dialed on first use and again
+// after an error.
+type redisStore struct {
+	config config.RedisConfig
+	codec  *Codec
+	prefix string
+	// infoKey is the hash of session information, fields are session ids
+	infoKey string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	locker sync.Mutex
+}
+
+// NewRedisStore returns a store which keeps states in redis, keys are prefixed by model name, states are
+// encoded by codec, nil codec stores plain states
+func NewRedisStore(redisConfig config.RedisConfig, name string, codec *Codec) Store {
+	if codec == nil {
+		codec = &Codec{}
+	}
+	if redisConfig.Timeout <= 0 {
+		redisConfig.Timeout = defaultRedisTimeout
+	}
+	return &redisStore{
+		config:  redisConfig,
+		codec:   codec,
+		prefix:  fmt.Sprintf("go-llama:session:%s:", name),
+		infoKey: fmt.Sprintf("go-llama:sessions:%s", name),
+	}
+}
+
+func (s *redisStore) Get(id string) (*model.State, error) {
+	reply, err := s.do("GET", s.prefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply: %v", reply)
+	}
+	state, err := s.codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.putInfo(Info{ID: id, Tokens: len(state.Tokens), Size: int64(len(data)), LastUsed: time.Now()}); err != nil {
+		klog.Warningf("failed to update session %s, err: %v", id, err)
+	}
+	return state, nil
+}
+
+func (s *redisStore) Put(id string, state *model.State) error {
+	data, err := s.codec.Encode(state)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do("SET", s.prefix+id, data); err != nil {
+		return err
+	}
+	return s.putInfo(Info{ID: id, Tokens: len(state.Tokens), Size: int64(len(data)), LastUsed: time.Now()})
+}
+
+func (s *redisStore) Delete(id string) error {
+	if _, err := s.do("DEL", s.prefix+id); err != nil {
+		return err
+	}
+	_, err := s.do("HDEL", s.infoKey, id)
+	return err
+}
+
+func (s *redisStore) Stat(id string) (*Info, error) {
+	reply, err := s.do("HGET", s.infoKey, id)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply: %v", reply)
+	}
+	return parseInfo(id, string(data))
+}
+
+func (s *redisStore) List() ([]Info, error) {
+	reply, err := s.do("HGETALL", s.infoKey)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items)%2 != 0 {
+		return nil, fmt.Errorf("unexpected redis reply: %v", reply)
+	}
+
+	infos := make([]Info, 0, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		id, _ := items[i].([]byte)
+		data, _ := items[i+1].([]byte)
+		info, err := parseInfo(string(id), string(data))
+		if err != nil {
+			klog.Warningf("failed to parse session %s, err: %v", id, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// putInfo records information of session as "tokens:size:last used unix milli"
+func (s *redisStore) putInfo(info Info) error {
+	value := fmt.Sprintf("%d:%d:%d", info.Tokens, info.Size, info.LastUsed.UnixMilli())
+	_, err := s.do("HSET", s.infoKey, info.ID, value)
+	return err
+}
+
+func parseInfo(id, value string) (*Info, error) {
+	var tokens int
+	var size, lastUsed int64
+	if _, err := fmt.Sscanf(value, "%d:%d:%d", &tokens, &size, &lastUsed); err != nil {
+		return nil, fmt.Errorf("invalid session info %q, err: %v", value, err)
+	}
+	return &Info{ID: id, Tokens: tokens, Size: size, LastUsed: time.UnixMilli(lastUsed)}, nil
+}
+
+func (s *redisStore) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.disconnect()
+}
+
+// do sends a command and returns its reply, which is nil, int64, string, []byte or []any
+func (s *redisStore) do(args ...any) (any, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	reply, err := s.roundTrip(args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			// the connection is in an unknown state
+			s.disconnect()
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (s *redisStore) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.config.Address, redisDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect redis %s, err: %v", s.config.Address, err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.config.Password != "" {
+		if _, err := s.roundTrip("AUTH", s.config.Password); err != nil {
+			s.disconnect()
+			return err
+		}
+	}
+	if s.config.DB != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.config.DB)); err != nil {
+			s.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+	return err
+}
+
+// roundTrip sends a command and reads its reply before timeout, the connection should be dropped on a timeout
+func (s *redisStore) roundTrip(args ...any) (any, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(s.config.Timeout)); err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(s.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var data []byte
+		switch v := arg.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		default:
+			return nil, fmt.Errorf("unsupported redis argument: %v", arg)
+		}
+		fmt.Fprintf(w, "$%d\r\n", len(data))
+		w.Write(data)
+		w.WriteString("\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(s.reader)
+}
+
+// redisError is an error reply of redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply: %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid redis reply: %q", line)
+}
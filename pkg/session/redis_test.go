@@ -0,0 +1,326 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/binding"
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// fakeRedis serves the subset of RESP commands used by redis store, keeping data in memory
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	locker  sync.Mutex
+	strings map[string][]byte
+	hashes  map[string]map[string][]byte
+	// hang makes the server read commands without replying
+	hang bool
+	// commands is every command received, in order
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, err: %v", err)
+	}
+	r := &fakeRedis{listener: listener, password: password, strings: map[string][]byte{}, hashes: map[string]map[string][]byte{}}
+	go r.serve()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) setHang(hang bool) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.hang = hang
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			data, _ := item.([]byte)
+			args[i] = string(data)
+		}
+
+		r.locker.Lock()
+		r.commands = append(r.commands, strings.Join(args, " "))
+		hang := r.hang
+		r.locker.Unlock()
+		if hang {
+			continue
+		}
+
+		var out string
+		if len(args) > 0 && strings.ToUpper(args[0]) == "AUTH" {
+			authed = len(args) == 2 && args[1] == r.password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		} else if !authed {
+			out = "-NOAUTH Authentication required.\r\n"
+		} else {
+			out = r.exec(args)
+		}
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func bulk(data []byte) string {
+	if data == nil {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(data), data)
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "SELECT" && len(args) == 2:
+		return "+OK\r\n"
+	case cmd == "GET" && len(args) == 2:
+		return bulk(r.strings[args[1]])
+	case cmd == "SET" && len(args) == 3:
+		r.strings[args[1]] = []byte(args[2])
+		return "+OK\r\n"
+	case cmd == "DEL" && len(args) == 2:
+		_, ok := r.strings[args[1]]
+		delete(r.strings, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case cmd == "HSET" && len(args) == 4:
+		if r.hashes[args[1]] == nil {
+			r.hashes[args[1]] = map[string][]byte{}
+		}
+		r.hashes[args[1]][args[2]] = []byte(args[3])
+		return ":1\r\n"
+	case cmd == "HGET" && len(args) == 3:
+		return bulk(r.hashes[args[1]][args[2]])
+	case cmd == "HDEL" && len(args) == 3:
+		delete(r.hashes[args[1]], args[2])
+		return ":1\r\n"
+	case cmd == "HGETALL" && len(args) == 2:
+		hash := r.hashes[args[1]]
+		out := fmt.Sprintf("*%d\r\n", len(hash)*2)
+		for field, value := range hash {
+			out += bulk([]byte(field)) + bulk(value)
+		}
+		return out
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func newTestRedisStore(t *testing.T, r *fakeRedis, redisConfig config.RedisConfig) Store {
+	t.Helper()
+	redisConfig.Address = r.addr()
+	store := NewRedisStore(redisConfig, "test", nil)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedisStoreRoundTrip(t *testing.T) {
+	r := newFakeRedis(t, "")
+	store := newTestRedisStore(t, r, config.RedisConfig{})
+
+	if _, err := store.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+	if _, err := store.Stat("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+
+	state := &model.State{Tokens: []binding.Token{1, 2, 3}, Data: []byte("state\r\n$-1\r\n")}
+	if err := store.Put("a", state); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	if err := store.Put("b", &model.State{Tokens: []binding.Token{4}, Data: []byte("b")}); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get, err: %v", err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("expected %v, got: %v", state, got)
+	}
+
+	info, err := store.Stat("a")
+	if err != nil {
+		t.Fatalf("failed to stat, err: %v", err)
+	}
+	if info.ID != "a" || info.Tokens != 3 || info.Size <= 0 || time.Since(info.LastUsed) > time.Minute {
+		t.Errorf("unexpected info: %+v", info)
+	}
+
+	infos, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list, err: %v", err)
+	}
+	ids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("expected sessions [a b], got: %v", ids)
+	}
+
+	if err := store.Delete("a"); err != nil {
+		t.Fatalf("failed to delete, err: %v", err)
+	}
+	if _, err := store.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got: %v", err)
+	}
+	if _, err := store.Stat("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got: %v", err)
+	}
+	// deleting a missing session is not an error
+	if err := store.Delete("a"); err != nil {
+		t.Errorf("failed to delete missing session, err: %v", err)
+	}
+}
+
+func TestRedisStoreEncrypted(t *testing.T) {
+	r := newFakeRedis(t, "")
+	codec := newTestCodec(t, true, testKey(1))
+	store := NewRedisStore(config.RedisConfig{Address: r.addr()}, "test", codec)
+	defer store.Close()
+
+	state := testState()
+	if err := store.Put("a", state); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	r.locker.Lock()
+	stored := string(r.strings["go-llama:session:test:a"])
+	r.locker.Unlock()
+	if strings.Contains(stored, "kv cache") {
+		t.Error("expected stored state to be encrypted")
+	}
+
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get, err: %v", err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("expected %v, got: %v", state, got)
+	}
+}
+
+func TestRedisStoreAuth(t *testing.T) {
+	r := newFakeRedis(t, "secret")
+
+	store := newTestRedisStore(t, r, config.RedisConfig{Password: "wrong"})
+	if err := store.Put("a", testState()); err == nil {
+		t.Error("expected error with wrong password")
+	}
+
+	store = newTestRedisStore(t, r, config.RedisConfig{Password: "secret", DB: 2})
+	if err := store.Put("a", testState()); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+	r.locker.Lock()
+	commands := strings.Join(r.commands, "\n")
+	r.locker.Unlock()
+	if !strings.Contains(commands, "SELECT 2") {
+		t.Errorf("expected db to be selected, commands: %s", commands)
+	}
+}
+
+func TestRedisStoreTimeout(t *testing.T) {
+	r := newFakeRedis(t, "")
+	store := newTestRedisStore(t, r, config.RedisConfig{Timeout: 100 * time.Millisecond})
+	if err := store.Put("a", testState()); err != nil {
+		t.Fatalf("failed to put, err: %v", err)
+	}
+
+	r.setHang(true)
+	start := time.Now()
+	_, err := store.Get("a")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected command to time out after 100ms, took: %v", elapsed)
+	}
+
+	// the connection left in an unknown state is dropped, and a new one is dialed
+	r.setHang(false)
+	if _, err := store.Get("a"); err != nil {
+		t.Errorf("failed to get after timeout, err: %v", err)
+	}
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	r := newFakeRedis(t, "")
+	redisStore := NewRedisStore(config.RedisConfig{Address: r.addr()}, "test", nil)
+	store := WithGC(redisStore, time.Hour, 0, time.Hour).(*gcStore)
+	defer store.Close()
+
+	for _, id := range []string{"old", "new"} {
+		if err := store.Put(id, testState()); err != nil {
+			t.Fatalf("failed to put, err: %v", err)
+		}
+	}
+	// session old was last used before ttl
+	r.locker.Lock()
+	r.hashes["go-llama:sessions:test"]["old"] = []byte(fmt.Sprintf("5:100:%d", time.Now().Add(-2*time.Hour).UnixMilli()))
+	r.locker.Unlock()
+
+	if err := store.collect(); err != nil {
+		t.Fatalf("failed to collect, err: %v", err)
+	}
+	if _, err := store.Get("old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected expired session to be collected, got: %v", err)
+	}
+	if _, err := store.Get("new"); err != nil {
+		t.Errorf("expected session to be kept, err: %v", err)
+	}
+}
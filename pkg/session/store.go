@@ -0,0 +1,119 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/bdqfork/go-llama.cpp/pkg/config"
+	"github.com/bdqfork/go-llama.cpp/pkg/model"
+)
+
+// Types of store
+const (
+	FileStore   = "file"
+	MemoryStore = "memory"
+	RedisStore  = "redis"
+)
+
+// maxIDLength is the max length of session id
+const maxIDLength = 256
+
+var (
+	// ErrNotFound is returned when state of session does not exist
+	ErrNotFound = errors.New("session not found")
+	// ErrInvalidID is returned when session id is not safe to be used as a file name or key
+	ErrInvalidID = fmt.Errorf("session id must be 1 to %d letters, digits, '.', '_' or '-', and must not contain '..'", maxIDLength)
+)
+
+// ValidateID checks that id only contains letters, digits, '.', '_' and '-', so that it can not escape the
+// directory or key space of store
+func ValidateID(id string) error {
+	if len(id) == 0 || len(id) > maxIDLength || strings.Contains(id, "..") {
+		return ErrInvalidID
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return ErrInvalidID
+		}
+	}
+	return nil
+}
+
+// Store persists states of chat sessions
+type Store interface {
+	io.Closer
+	// Get returns state of session, ErrNotFound if it does not exist
+	Get(id string) (*model.State, error)
+	// Put stores state of session, replacing the existing one
+	Put(id string, state *model.State) error
+	// Delete removes state of session, it is not an error if state does not exist
+	Delete(id string) error
+	// Stat returns information of session, ErrNotFound if it does not exist
+	Stat(id string) (*Info, error)
+	// List returns information of all sessions
+	List() ([]Info, error)
+}
+
+// Info is information of a stored session
+type Info struct {
+	ID string
+	// Tokens is the number of evaluated tokens in state
+	Tokens int
+	// Size is bytes used by state
+	Size int64
+	// LastUsed is the last time state is stored or loaded
+	LastUsed time.Time
+}
+
+// New returns the store configured for model. Sessions are stored in files when store is not set, unless
+// memory cache is configured.
+func New(modelConfig *config.ModelConfig) (Store, error) {
+	sessionConfig := modelConfig.Session
+	storeType := sessionConfig.Store
+	if storeType == "" {
+		storeType = FileStore
+		if sessionConfig.Cache.MaxBytes > 0 {
+			storeType = MemoryStore
+		}
+	}
+
+	codec, err := newCodec(sessionConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var store Store
+	switch storeType {
+	case FileStore:
+		store = NewFileStore(sessionConfig.Path, modelConfig.Name, codec)
+	case MemoryStore:
+		var spill Store
+		if sessionConfig.Cache.SpillPath != "" {
+			spill = NewFileStore(sessionConfig.Cache.SpillPath, modelConfig.Name, codec)
+		}
+		store = NewMemoryStore(sessionConfig.Cache.MaxBytes, spill)
+	case RedisStore:
+		store = NewRedisStore(sessionConfig.Redis, modelConfig.Name, codec)
+	default:
+		return nil, fmt.Errorf("unknown session store: %s", storeType)
+	}
+
+	// session files of the format before stores are left in path
+	var legacy *legacyFiles
+	if sessionConfig.Path != "" {
+		legacy = &legacyFiles{path: sessionConfig.Path, name: modelConfig.Name}
+	}
+	if sessionConfig.TTL > 0 || sessionConfig.MaxBytes > 0 {
+		store = withGC(store, sessionConfig.TTL, sessionConfig.MaxBytes, sessionConfig.GCInterval, legacy)
+	} else if legacy != nil {
+		if err := legacy.collect(0); err != nil {
+			klog.Errorf("failed to collect legacy session files, err: %v", err)
+		}
+	}
+	return store, nil
+}